@@ -108,6 +108,7 @@ data "template_file" "startup_script_vault" {
     consul_cluster_tag_name = var.consul_server_cluster_name
     vault_cluster_tag_name  = var.vault_cluster_name
     enable_vault_ui         = var.enable_vault_ui ? "--enable-ui" : ""
+    require_client_cert     = var.vault_tls_require_client_cert ? "--tls-client-ca-file $VAULT_TLS_CA_FILE --tls-require-and-verify-client-cert" : ""
   }
 }
 
@@ -13,7 +13,8 @@ exec > >(tee /var/log/startup-script.log|logger -t startup-script -s 2>/dev/cons
 # The Packer template puts the TLS certs in these file paths
 readonly VAULT_TLS_CERT_FILE="/opt/vault/tls/vault.crt.pem"
 readonly VAULT_TLS_KEY_FILE="/opt/vault/tls/vault.key.pem"
+readonly VAULT_TLS_CA_FILE="/opt/vault/tls/ca.crt.pem"
 
 # Note that any variables below with <dollar-sign><curly-brace><var-name><curly-brace> are expected to be interpolated by Terraform.
 /opt/consul/bin/run-consul --client --cluster-tag-name "${consul_cluster_tag_name}"
-/opt/vault/bin/run-vault --gcs-bucket ${vault_cluster_tag_name} --tls-cert-file "$VAULT_TLS_CERT_FILE" --tls-key-file "$VAULT_TLS_KEY_FILE" ${enable_vault_ui}
+/opt/vault/bin/run-vault --gcs-bucket ${vault_cluster_tag_name} --tls-cert-file "$VAULT_TLS_CERT_FILE" --tls-key-file "$VAULT_TLS_KEY_FILE" ${enable_vault_ui} ${require_client_cert}
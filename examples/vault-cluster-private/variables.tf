@@ -106,6 +106,12 @@ variable "enable_vault_ui" {
   default     = true
 }
 
+variable "vault_tls_require_client_cert" {
+  description = "If true, Vault only accepts clients that present a cert signed by the CA the Packer template puts in /opt/vault/tls/ca.crt.pem. Note that the vault CLI on the nodes doesn't present one."
+  type        = bool
+  default     = false
+}
+
 variable "network_name" {
   description = "The name of the VPC Network where all resources should be created."
   type        = string
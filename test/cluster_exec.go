@@ -0,0 +1,174 @@
+package test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/ssh"
+)
+
+// How many nodes the cluster-wide helpers talk to at the same time by default
+const DEFAULT_MAX_PARALLEL_NODES = 5
+
+// How many nodes a cluster-wide operation has to succeed on
+type SuccessMode int
+
+const (
+	// Every node has to succeed
+	RequireAll SuccessMode = iota
+	// At least one node has to succeed
+	RequireAny
+	// More than half of the nodes have to succeed, like a Consul or Raft quorum
+	RequireQuorum
+)
+
+func (m SuccessMode) String() string {
+	switch m {
+	case RequireAll:
+		return "all nodes"
+	case RequireAny:
+		return "any node"
+	case RequireQuorum:
+		return "a quorum of nodes"
+	default:
+		return fmt.Sprintf("SuccessMode(%d)", int(m))
+	}
+}
+
+// The output and error of an operation on a single node
+type NodeResult struct {
+	Output string
+	Err    error
+}
+
+// The results of an operation on every node of a cluster, keyed by hostname
+type NodeResults map[string]NodeResult
+
+// Returns the hostnames of the nodes the operation succeeded on, sorted
+func (r NodeResults) Succeeded() []string {
+	hostnames := []string{}
+	for hostname, result := range r {
+		if result.Err == nil {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// Returns the hostnames of the nodes the operation failed on, sorted
+func (r NodeResults) Failed() []string {
+	hostnames := []string{}
+	for hostname, result := range r {
+		if result.Err != nil {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// Returns an error listing every failed node if the operation didn't succeed on enough nodes for the given mode
+func (r NodeResults) Check(mode SuccessMode) error {
+	if len(r) == 0 {
+		return fmt.Errorf("Expected %s to succeed, but there are no nodes", mode)
+	}
+	succeeded := len(r.Succeeded())
+
+	var ok bool
+	switch mode {
+	case RequireAll:
+		ok = succeeded == len(r)
+	case RequireAny:
+		ok = succeeded > 0
+	case RequireQuorum:
+		ok = succeeded > len(r)/2
+	default:
+		return fmt.Errorf("Unknown success mode %d", int(mode))
+	}
+	if ok {
+		return nil
+	}
+
+	failures := []string{}
+	for _, hostname := range r.Failed() {
+		failures = append(failures, fmt.Sprintf("%s: %v", hostname, r[hostname].Err))
+	}
+	return fmt.Errorf("Expected %s to succeed, but only %d of %d did. Failures:\n%s", mode, succeeded, len(r), strings.Join(failures, "\n"))
+}
+
+// Run the given function for each of the given keys concurrently, running at most maxParallel at a time, and return the
+// results keyed by the given keys. A maxParallel of zero or less means DEFAULT_MAX_PARALLEL_NODES. The function must
+// not call t.Fatal, as that only works from the goroutine running the test.
+func runConcurrently(keys []string, maxParallel int, fn func(key string) (string, error)) NodeResults {
+	if maxParallel <= 0 {
+		maxParallel = DEFAULT_MAX_PARALLEL_NODES
+	}
+
+	results := NodeResults{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxParallel)
+
+	for _, key := range keys {
+		key := key
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			output, err := fn(key)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			results[key] = NodeResult{Output: output, Err: err}
+		}()
+	}
+
+	wg.Wait()
+	return results
+}
+
+// Run the given function for every node of the cluster concurrently, at most maxParallel at a time, and return the
+// result of each node keyed by hostname. The function must not call t.Fatal, so use the E variants of the helpers.
+func (c *VaultCluster) ForEachNode(maxParallel int, fn func(node ssh.Host) (string, error)) NodeResults {
+	nodes := map[string]ssh.Host{}
+	hostnames := []string{}
+	for _, node := range c.GetSshHosts() {
+		nodes[node.Hostname] = node
+		hostnames = append(hostnames, node.Hostname)
+	}
+
+	return runConcurrently(hostnames, maxParallel, func(hostname string) (string, error) {
+		return fn(nodes[hostname])
+	})
+}
+
+// Run the given command on every node of the cluster concurrently and return the result of each node, failing the test
+// if it didn't succeed on enough nodes for the given mode
+func (c *VaultCluster) RunOnNodes(t *testing.T, bastionHost *ssh.Host, command string, mode SuccessMode) NodeResults {
+	results, err := c.RunOnNodesE(t, bastionHost, command, mode)
+	if err != nil {
+		t.Fatalf("Failed to run `%s` on the Vault cluster: %v", command, err)
+	}
+	return results
+}
+
+// Run the given command on every node of the cluster concurrently and return the result of each node, and an error if
+// it didn't succeed on enough nodes for the given mode
+func (c *VaultCluster) RunOnNodesE(t *testing.T, bastionHost *ssh.Host, command string, mode SuccessMode) (NodeResults, error) {
+	executors := map[string]Executor{}
+	for _, node := range c.GetSshHosts() {
+		executors[node.Hostname] = c.NodeExecutor(t, node, bastionHost)
+	}
+
+	results := c.ForEachNode(DEFAULT_MAX_PARALLEL_NODES, func(node ssh.Host) (string, error) {
+		return runCommand(executors[node.Hostname], command)
+	})
+	return results, results.Check(mode)
+}
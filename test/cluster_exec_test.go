@@ -0,0 +1,99 @@
+package test
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/ssh"
+)
+
+func TestNodeResultsCheck(t *testing.T) {
+	t.Parallel()
+
+	failed := NodeResult{Err: fmt.Errorf("Connection refused")}
+	oneOfThree := NodeResults{"vault-node-0": {}, "vault-node-1": failed, "vault-node-2": failed}
+	twoOfThree := NodeResults{"vault-node-0": {}, "vault-node-1": {}, "vault-node-2": failed}
+	threeOfThree := NodeResults{"vault-node-0": {}, "vault-node-1": {}, "vault-node-2": {}}
+	noneOfThree := NodeResults{"vault-node-0": failed, "vault-node-1": failed, "vault-node-2": failed}
+
+	testCases := []struct {
+		results NodeResults
+		mode    SuccessMode
+		ok      bool
+	}{
+		{threeOfThree, RequireAll, true},
+		{twoOfThree, RequireAll, false},
+		{twoOfThree, RequireQuorum, true},
+		{oneOfThree, RequireQuorum, false},
+		{oneOfThree, RequireAny, true},
+		{noneOfThree, RequireAny, false},
+		{NodeResults{}, RequireAny, false},
+	}
+
+	for _, testCase := range testCases {
+		err := testCase.results.Check(testCase.mode)
+		if (err == nil) != testCase.ok {
+			t.Errorf("Expected %d of %d successful nodes to pass the check for %s to be %t, but got: %v", len(testCase.results.Succeeded()), len(testCase.results), testCase.mode, testCase.ok, err)
+		}
+	}
+}
+
+func TestRunConcurrentlyBoundsParallelism(t *testing.T) {
+	t.Parallel()
+
+	keys := []string{}
+	for i := 0; i < 10; i++ {
+		keys = append(keys, strconv.Itoa(i))
+	}
+
+	var running, maxRunning int32
+	results := runConcurrently(keys, 3, func(key string) (string, error) {
+		now := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			seen := atomic.LoadInt32(&maxRunning)
+			if now <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, now) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return key, nil
+	})
+
+	if maxRunning > 3 {
+		t.Fatalf("Expected at most 3 functions to run at the same time, but %d did", maxRunning)
+	}
+	if len(results) != len(keys) || results["7"].Output != "7" {
+		t.Fatalf("Expected a result for every key, but got: %v", results)
+	}
+}
+
+func TestRunOnNodesReturnsResultPerNode(t *testing.T) {
+	t.Parallel()
+
+	cluster := &VaultCluster{Executors: map[string]Executor{}}
+	for i := 0; i < 3; i++ {
+		hostname := fmt.Sprintf("vault-node-%d", i)
+		scripted := ScriptedCommand{Match: `^sudo supervisorctl status vault$`, Output: "vault    RUNNING\n"}
+		if i == 2 {
+			scripted = ScriptedCommand{Match: scripted.Match, Output: "vault    STOPPED\n", ExitCode: 3}
+		}
+		cluster.Nodes = append(cluster.Nodes, ssh.Host{Hostname: hostname})
+		cluster.Executors[hostname] = &FakeExecutor{Host: hostname, Script: []ScriptedCommand{scripted, scripted}}
+	}
+
+	if _, err := cluster.RunOnNodesE(t, nil, "sudo supervisorctl status vault", RequireAll); err == nil {
+		t.Fatal("Expected the command to fail when one node fails and all nodes are required")
+	}
+
+	results := cluster.RunOnNodes(t, nil, "sudo supervisorctl status vault", RequireQuorum)
+	if results["vault-node-0"].Output != "vault    RUNNING\n" || results["vault-node-2"].Output != "vault    STOPPED\n" {
+		t.Fatalf("Unexpected results: %v", results)
+	}
+	if failed := results.Failed(); len(failed) != 1 || failed[0] != "vault-node-2" {
+		t.Fatalf("Expected only vault-node-2 to fail, but got: %v", failed)
+	}
+}
@@ -0,0 +1,391 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+const DEFAULT_SSH_PORT = 22
+const SSH_DIAL_TIMEOUT = 30 * time.Second
+
+// Runs shell commands on a host. The helpers that need to run commands on a Vault node take an Executor, so they don't
+// need to know how the node is reached.
+type Executor interface {
+	// The host the commands run on, for use in logs and error messages
+	Hostname() string
+	// Run the given command and return its result. The error is a *ConnectionError if the command couldn't be run
+	// because the host couldn't be reached, and a *CommandExitError if it ran but exited with a non-zero exit code. The
+	// result is nil if the command didn't run.
+	Exec(command string) (*CommandResult, error)
+}
+
+// The result of a command run by an Executor
+type CommandResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+}
+
+// Returned by an Executor when the host couldn't be reached, or the connection broke before the command finished. The
+// host may just not be up yet, so it's usually worth retrying.
+type ConnectionError struct {
+	Hostname string
+	Err      error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("Failed to connect to %s: %v", e.Hostname, e.Err)
+}
+
+// Returned by an Executor when the command ran but exited with a non-zero exit code
+type CommandExitError struct {
+	Hostname string
+	Command  string // May contain unseal keys, tokens or private keys, so it's left out of the error message
+	Result   *CommandResult
+}
+
+func (e *CommandExitError) Error() string {
+	return fmt.Sprintf("Command `%s` on %s exited with status %d. Stderr: %s", getCommandProgram(e.Command), e.Hostname, e.Result.ExitCode, strings.TrimSpace(e.Result.Stderr))
+}
+
+// Matches an environment variable assignment in front of a command, e.g. VAULT_TOKEN='...'
+var envAssignmentRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// Returns the name of the program the given command runs, e.g. vault for `VAULT_TOKEN='...' vault token lookup`, to
+// describe the command without any of the secrets in its arguments, environment or input
+func getCommandProgram(command string) string {
+	for _, field := range strings.Fields(command) {
+		if !envAssignmentRegexp.MatchString(field) {
+			return field
+		}
+	}
+	return ""
+}
+
+// Run the given command with the given executor and return its stdout. Stderr is left out, so warnings printed by the
+// command don't end up in output that is parsed, but it's part of the error if the command fails.
+func runCommand(executor Executor, command string) (string, error) {
+	result, err := executor.Exec(command)
+	if result == nil {
+		return "", err
+	}
+	return result.Stdout, err
+}
+
+// The exit codes curl fails with when it can't connect to the server, or the connection times out or breaks
+var curlConnectionExitCodes = map[int]bool{7: true, 28: true, 52: true, 56: true}
+
+// Returns true if the given error means the host couldn't be reached, rather than that the command failed. Not reaching
+// Vault on the host counts too, as it's usually still starting: a Vault API client that can't connect, curl exiting with
+// a connection error, or the vault CLI failing to dial.
+func isConnectionError(err error) bool {
+	switch err := err.(type) {
+	case *ConnectionError:
+		return true
+	case *url.Error:
+		_, ok := err.Err.(net.Error)
+		return ok
+	case *CommandExitError:
+		if strings.HasPrefix(err.Command, "curl ") {
+			return curlConnectionExitCodes[err.Result.ExitCode]
+		}
+		return strings.Contains(err.Result.Stderr, "dial tcp")
+	default:
+		return false
+	}
+}
+
+// Returns the given error as is if it's a connection error, and wrapped in a retry.FatalError otherwise. Use it in a
+// retry loop that should wait for a host to be reachable, but not run a command again once it ran and failed.
+func retryOnlyConnectionErrors(err error) error {
+	if err == nil || isConnectionError(err) {
+		return err
+	}
+	return retry.FatalError{Underlying: err}
+}
+
+// Returns the executor for the given node: the one set in Executors for it if there is one, otherwise one that SSHes to
+// the node through the given bastion host or, if there is no bastion host, directly
+func (c *VaultCluster) NodeExecutor(t *testing.T, node ssh.Host, bastionHost *ssh.Host) Executor {
+	if executor, ok := c.Executors[node.Hostname]; ok {
+		return executor
+	}
+	return newSshExecutor(node, bastionHost)
+}
+
+// Returns an executor that SSHes to the given host through the given bastion host or, if there is no bastion host,
+// directly
+func newSshExecutor(host ssh.Host, bastionHost *ssh.Host) Executor {
+	if bastionHost != nil {
+		return newBastionSshExecutor(SshHop{Host: *bastionHost}, SshHop{Host: host})
+	}
+	return newDirectSshExecutor(SshHop{Host: host})
+}
+
+// An Executor that SSHes directly to the host
+type DirectSshExecutor struct {
+	Host SshHop
+}
+
+func newDirectSshExecutor(host SshHop) *DirectSshExecutor {
+	return &DirectSshExecutor{Host: host}
+}
+
+func (e *DirectSshExecutor) Hostname() string {
+	return e.Host.Host.Hostname
+}
+
+func (e *DirectSshExecutor) Exec(command string) (*CommandResult, error) {
+	return newMultiHopSshExecutor(e.Host).Exec(command)
+}
+
+// An Executor that SSHes to the host through a bastion host. This is how the nodes of the private clusters are reached.
+type BastionSshExecutor struct {
+	Bastion SshHop
+	Host    SshHop
+}
+
+func newBastionSshExecutor(bastionHost SshHop, host SshHop) *BastionSshExecutor {
+	return &BastionSshExecutor{Bastion: bastionHost, Host: host}
+}
+
+func (e *BastionSshExecutor) Hostname() string {
+	return e.Host.Host.Hostname
+}
+
+func (e *BastionSshExecutor) Exec(command string) (*CommandResult, error) {
+	return newMultiHopSshExecutor(e.Bastion, e.Host).Exec(command)
+}
+
+// A host to SSH to on the way to the host commands run on
+type SshHop struct {
+	Host ssh.Host
+	Port int // Defaults to 22
+}
+
+// An Executor that SSHes through any number of jump hosts. The last hop is the host commands run on, and each earlier
+// hop is used to reach the next one. Only key pair authentication is supported.
+type MultiHopSshExecutor struct {
+	Hops []SshHop
+}
+
+func newMultiHopSshExecutor(hops ...SshHop) *MultiHopSshExecutor {
+	return &MultiHopSshExecutor{Hops: hops}
+}
+
+func (e *MultiHopSshExecutor) Hostname() string {
+	if len(e.Hops) == 0 {
+		return ""
+	}
+	return e.Hops[len(e.Hops)-1].Host.Hostname
+}
+
+func (e *MultiHopSshExecutor) Exec(command string) (*CommandResult, error) {
+	start := time.Now()
+
+	clients, err := dialSshHops(e.Hops)
+	defer closeSshClients(clients)
+	if err != nil {
+		return nil, &ConnectionError{Hostname: e.Hostname(), Err: err}
+	}
+
+	session, err := clients[len(clients)-1].NewSession()
+	if err != nil {
+		return nil, &ConnectionError{Hostname: e.Hostname(), Err: fmt.Errorf("Failed to open SSH session: %v", err)}
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Run(command)
+
+	result := &CommandResult{Stdout: stdout.String(), Stderr: stderr.String(), Duration: time.Since(start)}
+	switch err := err.(type) {
+	case nil:
+		return result, nil
+	case *cryptossh.ExitError:
+		result.ExitCode = err.ExitStatus()
+		return result, &CommandExitError{Hostname: e.Hostname(), Command: command, Result: result}
+	default:
+		// E.g. the connection dropped before the command sent its exit status
+		return result, &ConnectionError{Hostname: e.Hostname(), Err: err}
+	}
+}
+
+// Connect to each of the given hops through the previous one and return the clients in the same order. On error, the
+// clients that did connect are returned too, so they can be closed.
+func dialSshHops(hops []SshHop) ([]*cryptossh.Client, error) {
+	clients := []*cryptossh.Client{}
+	if len(hops) == 0 {
+		return clients, fmt.Errorf("At least one SSH hop is required")
+	}
+
+	for i, hop := range hops {
+		config, err := newSshClientConfig(hop.Host)
+		if err != nil {
+			return clients, err
+		}
+
+		port := hop.Port
+		if port == 0 {
+			port = DEFAULT_SSH_PORT
+		}
+		address := net.JoinHostPort(hop.Host.Hostname, strconv.Itoa(port))
+
+		if i == 0 {
+			client, err := cryptossh.Dial("tcp", address, config)
+			if err != nil {
+				return clients, fmt.Errorf("Failed to SSH to %s: %v", address, err)
+			}
+			clients = append(clients, client)
+			continue
+		}
+
+		conn, err := clients[i-1].Dial("tcp", address)
+		if err != nil {
+			return clients, fmt.Errorf("Failed to reach %s through %s: %v", address, hops[i-1].Host.Hostname, err)
+		}
+		clientConn, channels, requests, err := cryptossh.NewClientConn(conn, address, config)
+		if err != nil {
+			conn.Close()
+			return clients, fmt.Errorf("Failed to SSH to %s through %s: %v", address, hops[i-1].Host.Hostname, err)
+		}
+		clients = append(clients, cryptossh.NewClient(clientConn, channels, requests))
+	}
+
+	return clients, nil
+}
+
+// Close the given clients, starting with the last hop
+func closeSshClients(clients []*cryptossh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
+
+// Build the SSH client config for the given host from its user name and key pair. Like terratest, we don't verify
+// host keys, as the hosts are created by the test.
+func newSshClientConfig(host ssh.Host) (*cryptossh.ClientConfig, error) {
+	if host.SshKeyPair == nil {
+		return nil, fmt.Errorf("No SSH key pair set for host %s", host.Hostname)
+	}
+
+	signer, err := cryptossh.ParsePrivateKey([]byte(host.SshKeyPair.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse SSH private key for host %s: %v", host.Hostname, err)
+	}
+
+	return &cryptossh.ClientConfig{
+		User:            host.SshUserName,
+		Auth:            []cryptossh.AuthMethod{cryptossh.PublicKeys(signer)},
+		HostKeyCallback: cryptossh.InsecureIgnoreHostKey(),
+		Timeout:         SSH_DIAL_TIMEOUT,
+	}, nil
+}
+
+// An Executor that runs commands with bash on the machine running the test, e.g. against a Vault dev server
+type LocalExecutor struct{}
+
+func (e *LocalExecutor) Hostname() string {
+	return "localhost"
+}
+
+func (e *LocalExecutor) Exec(command string) (*CommandResult, error) {
+	start := time.Now()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	result := &CommandResult{Stdout: stdout.String(), Stderr: stderr.String(), Duration: time.Since(start)}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		return result, &CommandExitError{Hostname: e.Hostname(), Command: command, Result: result}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// A command a FakeExecutor expects, and what it returns for it
+type ScriptedCommand struct {
+	Match    string // Regular expression the command has to match
+	Output   string // Stdout of the command
+	Stderr   string
+	ExitCode int   // A non-zero exit code makes the command fail with a *CommandExitError
+	Err      error // Returned instead of a result, e.g. a *ConnectionError for a host that can't be reached
+}
+
+// An Executor that doesn't run anything, but expects the commands in its script in order and returns the scripted
+// output for each. Use it to test helpers without a Vault cluster.
+type FakeExecutor struct {
+	Host     string
+	Script   []ScriptedCommand
+	Commands []string // The commands run so far
+
+	mutex sync.Mutex
+}
+
+func (e *FakeExecutor) Hostname() string {
+	return e.Host
+}
+
+func (e *FakeExecutor) Exec(command string) (*CommandResult, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	index := len(e.Commands)
+	e.Commands = append(e.Commands, command)
+
+	if index >= len(e.Script) {
+		return nil, fmt.Errorf("Unexpected command %d on fake host %s: %s", index+1, e.Host, command)
+	}
+
+	scripted := e.Script[index]
+	matched, err := regexp.MatchString(scripted.Match, command)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pattern for command %d on fake host %s: %v", index+1, e.Host, err)
+	}
+	if !matched {
+		return nil, fmt.Errorf("Expected command %d on fake host %s to match %q, but got: %s", index+1, e.Host, scripted.Match, command)
+	}
+	if scripted.Err != nil {
+		return nil, scripted.Err
+	}
+
+	result := &CommandResult{Stdout: scripted.Output, Stderr: scripted.Stderr, ExitCode: scripted.ExitCode}
+	if result.ExitCode != 0 {
+		return result, &CommandExitError{Hostname: e.Host, Command: command, Result: result}
+	}
+	return result, nil
+}
+
+// Returns an error if not all commands in the script were run
+func (e *FakeExecutor) CheckScriptDone() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if len(e.Commands) < len(e.Script) {
+		return fmt.Errorf("Expected %d commands on fake host %s, but only %d were run", len(e.Script), e.Host, len(e.Commands))
+	}
+	return nil
+}
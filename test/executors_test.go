@@ -0,0 +1,281 @@
+package test
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+)
+
+func TestMultiHopSshExecutorRunsCommandOnTestServer(t *testing.T) {
+	t.Parallel()
+
+	keyPair := ssh.GenerateRSAKeyPair(t, 2048)
+	backend := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^vault --version$`, Output: "Vault v0.11.5+ent ('abc')\n"},
+	}}
+	server := startTestSshServer(t, keyPair, backend)
+	defer server.Stop()
+
+	output, err := runCommand(newMultiHopSshExecutor(server.Hop()), "vault --version")
+	if err != nil {
+		t.Fatalf("Expected command to succeed, but got: %v", err)
+	}
+	if output != "Vault v0.11.5+ent ('abc')\n" {
+		t.Fatalf("Unexpected output: %q", output)
+	}
+	if err := backend.CheckScriptDone(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiHopSshExecutorReachesHostThroughJumpHost(t *testing.T) {
+	t.Parallel()
+
+	keyPair := ssh.GenerateRSAKeyPair(t, 2048)
+	jumpHost := startTestSshServer(t, keyPair, &FakeExecutor{Host: "bastion"})
+	defer jumpHost.Stop()
+	backend := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^hostname$`, Output: "vault-node-0\n"},
+	}}
+	node := startTestSshServer(t, keyPair, backend)
+	defer node.Stop()
+
+	output, err := runCommand(newMultiHopSshExecutor(jumpHost.Hop(), node.Hop()), "hostname")
+	if err != nil {
+		t.Fatalf("Expected command to succeed through the jump host, but got: %v", err)
+	}
+	if output != "vault-node-0\n" {
+		t.Fatalf("Unexpected output: %q", output)
+	}
+}
+
+func TestMultiHopSshExecutorReturnsExitStatusOfFailedCommand(t *testing.T) {
+	t.Parallel()
+
+	keyPair := ssh.GenerateRSAKeyPair(t, 2048)
+	backend := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^vault status$`, Output: "Sealed true\n", Stderr: "WARNING! VAULT_ADDR is not set\n", ExitCode: 2},
+	}}
+	server := startTestSshServer(t, keyPair, backend)
+	defer server.Stop()
+
+	result, err := newMultiHopSshExecutor(server.Hop()).Exec("vault status")
+	exitErr, ok := err.(*CommandExitError)
+	if !ok {
+		t.Fatalf("Expected a *CommandExitError, but got: %v", err)
+	}
+	if exitErr.Result.ExitCode != 2 || result.ExitCode != 2 {
+		t.Fatalf("Expected exit code 2, but got %d", exitErr.Result.ExitCode)
+	}
+	if result.Stdout != "Sealed true\n" || result.Stderr != "WARNING! VAULT_ADDR is not set\n" {
+		t.Fatalf("Expected stdout and stderr to be returned separately, but got: %+v", result)
+	}
+	if !strings.Contains(err.Error(), "VAULT_ADDR is not set") {
+		t.Fatalf("Expected the error to include stderr, but got: %v", err)
+	}
+	if isConnectionError(err) {
+		t.Fatalf("Expected a command that ran not to be a connection error: %v", err)
+	}
+}
+
+func TestMultiHopSshExecutorFailsWithUnknownKeyPair(t *testing.T) {
+	t.Parallel()
+
+	server := startTestSshServer(t, ssh.GenerateRSAKeyPair(t, 2048), &FakeExecutor{Host: "vault-node-0"})
+	defer server.Stop()
+
+	hop := server.Hop()
+	hop.Host.SshKeyPair = ssh.GenerateRSAKeyPair(t, 2048)
+
+	result, err := newMultiHopSshExecutor(hop).Exec("exit")
+	if !isConnectionError(err) {
+		t.Fatalf("Expected SSH with an unknown key pair to fail with a *ConnectionError, but got: %v", err)
+	}
+	if result != nil {
+		t.Fatalf("Expected no result for a command that didn't run, but got: %+v", result)
+	}
+}
+
+func TestRetryOnlyConnectionErrors(t *testing.T) {
+	t.Parallel()
+
+	if err := retryOnlyConnectionErrors(nil); err != nil {
+		t.Fatalf("Expected nil, but got: %v", err)
+	}
+
+	connectionErr := &ConnectionError{Hostname: "vault-node-0", Err: fmt.Errorf("connection refused")}
+	if err := retryOnlyConnectionErrors(connectionErr); err != connectionErr {
+		t.Fatalf("Expected a connection error to be retried, but got: %v", err)
+	}
+
+	exitErr := &CommandExitError{Hostname: "vault-node-0", Command: "exit 1", Result: &CommandResult{ExitCode: 1}}
+	if _, ok := retryOnlyConnectionErrors(exitErr).(retry.FatalError); !ok {
+		t.Fatalf("Expected a failed command to be a retry.FatalError")
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	t.Parallel()
+
+	exitErr := func(command string, exitCode int, stderr string) error {
+		return &CommandExitError{Hostname: "vault-node-0", Command: command, Result: &CommandResult{ExitCode: exitCode, Stderr: stderr}}
+	}
+	testCases := []struct {
+		description string
+		err         error
+		expected    bool
+	}{
+		{"SSH connection error", &ConnectionError{Hostname: "vault-node-0", Err: fmt.Errorf("connection refused")}, true},
+		{"API client that can't connect", &url.Error{Op: "Get", URL: "https://vault-node-0:8200", Err: &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}}, true},
+		{"API client that doesn't trust the cert", &url.Error{Op: "Get", URL: "https://vault-node-0:8200", Err: x509.UnknownAuthorityError{}}, false},
+		{"curl that can't connect", exitErr("curl -s 'https://127.0.0.1:8200/v1/sys/health'", 7, ""), true},
+		{"curl that times out", exitErr("curl -s 'https://127.0.0.1:8200/v1/sys/health'", 28, ""), true},
+		{"curl that doesn't trust the cert", exitErr("curl -s 'https://127.0.0.1:8200/v1/sys/health'", 60, ""), false},
+		{"vault CLI that can't resolve Vault", exitErr("vault status -address=https://vault.service.consul:8200", 2, "Error checking seal status: Get https://vault.service.consul:8200/v1/sys/seal-status: dial tcp: lookup vault.service.consul: no such host\n"), true},
+		{"vault CLI of a sealed node", exitErr("vault status", 2, ""), false},
+		{"command that failed", exitErr("sudo supervisorctl restart vault", 1, "vault: ERROR (no such process)\n"), false},
+		{"other error", fmt.Errorf("Failed to parse response"), false},
+		{"no error", nil, false},
+	}
+
+	for _, testCase := range testCases {
+		if actual := isConnectionError(testCase.err); actual != testCase.expected {
+			t.Errorf("Expected isConnectionError to be %t for a %s, but got %t", testCase.expected, testCase.description, actual)
+		}
+	}
+}
+
+func TestCommandExitErrorLeavesOutSecrets(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name            string
+		command         string
+		secret          string
+		expectedProgram string
+	}{
+		{"Token in environment", "VAULT_TOKEN='s.rootToken' vault token lookup -format=json", "s.rootToken", "vault"},
+		{"Unseal key in argument", "vault operator rekey -nonce='abc' -format=json 'unsealKey'", "unsealKey", "vault"},
+		{"Unseal key in request body", `curl -s -X PUT 'https://127.0.0.1:8200/v1/sys/unseal' -d '{"key": "unsealKey"}'`, "unsealKey", "curl"},
+		{"Private key in input", "sudo tee '/opt/vault/tls/vault.key.pem.new' > /dev/null <<'EOF'\nPRIVATE KEY\nEOF", "PRIVATE KEY", "sudo"},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			err := &CommandExitError{Hostname: "vault-node-0", Command: testCase.command, Result: &CommandResult{ExitCode: 2, Stderr: "Error\n"}}
+			if strings.Contains(err.Error(), testCase.secret) {
+				t.Fatalf("Expected the error to leave out %q, but got: %v", testCase.secret, err)
+			}
+			if !strings.HasPrefix(err.Error(), fmt.Sprintf("Command `%s` on vault-node-0 exited with status 2", testCase.expectedProgram)) {
+				t.Fatalf("Expected the error to name the program %s, but got: %v", testCase.expectedProgram, err)
+			}
+		})
+	}
+}
+
+func TestDirectSshExecutorRunsCommandOnTestServer(t *testing.T) {
+	t.Parallel()
+
+	backend := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^vault status$`, Output: "Sealed true\n", ExitCode: 2},
+	}}
+	server := startTestSshServer(t, ssh.GenerateRSAKeyPair(t, 2048), backend)
+	defer server.Stop()
+
+	executor := newDirectSshExecutor(server.Hop())
+	result, err := executor.Exec("vault status")
+	if _, ok := err.(*CommandExitError); !ok {
+		t.Fatalf("Expected a *CommandExitError, but got: %v", err)
+	}
+	if result.Stdout != "Sealed true\n" || result.ExitCode != 2 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	if executor.Hostname() != server.Host.Hostname {
+		t.Fatalf("Expected hostname %s, but got %s", server.Host.Hostname, executor.Hostname())
+	}
+}
+
+func TestBastionSshExecutorReachesHostThroughBastion(t *testing.T) {
+	t.Parallel()
+
+	keyPair := ssh.GenerateRSAKeyPair(t, 2048)
+	bastion := startTestSshServer(t, keyPair, &FakeExecutor{Host: "bastion"})
+	defer bastion.Stop()
+	backend := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^hostname$`, Output: "vault-node-0\n"},
+	}}
+	node := startTestSshServer(t, keyPair, backend)
+	defer node.Stop()
+
+	output, err := runCommand(newBastionSshExecutor(bastion.Hop(), node.Hop()), "hostname")
+	if err != nil {
+		t.Fatalf("Expected command to succeed through the bastion host, but got: %v", err)
+	}
+	if output != "vault-node-0\n" {
+		t.Fatalf("Unexpected output: %q", output)
+	}
+
+	bastion.Stop()
+	if _, err := newBastionSshExecutor(bastion.Hop(), node.Hop()).Exec("hostname"); !isConnectionError(err) {
+		t.Fatalf("Expected a bastion host that's down to be a connection error, but got: %v", err)
+	}
+}
+
+func TestLocalExecutorReturnsStdoutStderrAndExitCode(t *testing.T) {
+	t.Parallel()
+
+	result, err := (&LocalExecutor{}).Exec("echo 200; echo 'a warning' >&2; exit 3")
+	if _, ok := err.(*CommandExitError); !ok {
+		t.Fatalf("Expected a *CommandExitError, but got: %v", err)
+	}
+	if result.Stdout != "200\n" || result.Stderr != "a warning\n" || result.ExitCode != 3 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+}
+
+func TestFakeExecutorFailsOnUnexpectedCommand(t *testing.T) {
+	t.Parallel()
+
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^sudo supervisorctl restart vault$`},
+	}}
+
+	if _, err := executor.Exec("sudo supervisorctl stop vault"); err == nil {
+		t.Fatal("Expected a command that doesn't match the script to fail")
+	}
+	if _, err := executor.Exec("sudo supervisorctl restart vault"); err == nil {
+		t.Fatal("Expected a command past the end of the script to fail")
+	}
+}
+
+func TestNodeExecutorUsesExecutorSetForNode(t *testing.T) {
+	t.Parallel()
+
+	keyPair := ssh.GenerateRSAKeyPair(t, 2048)
+	backend := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^exit$`},
+		{Match: `^sudo supervisorctl restart vault$`, Output: "vault: stopped\nvault: started\n"},
+	}}
+	server := startTestSshServer(t, keyPair, backend)
+	defer server.Stop()
+
+	cluster := &VaultCluster{
+		Nodes:     []ssh.Host{{Hostname: "vault-node-0"}},
+		Executors: map[string]Executor{"vault-node-0": newMultiHopSshExecutor(server.Hop())},
+	}
+
+	verifyCanSsh(t, cluster, nil)
+	restartVault(t, cluster.NodeExecutor(t, cluster.Nodes[0], nil))
+
+	if err := backend.CheckScriptDone(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// A PGP key pair generated for a test. Both keys are base64-encoded binary keys, which is the format Vault accepts for
+// -pgp-keys and -root-token-pgp-key and the format it uses when returning encrypted values.
+type PgpKeyPair struct {
+	Name       string
+	PublicKey  string
+	PrivateKey string
+}
+
+// Generate a PGP key pair that can be used to encrypt unseal keys, recovery keys or root tokens
+func generatePgpKeyPair(t *testing.T, name string) *PgpKeyPair {
+	keyPair, err := generatePgpKeyPairE(name)
+	if err != nil {
+		t.Fatalf("Failed to generate PGP key pair %s: %v", name, err)
+	}
+	return keyPair
+}
+
+// Generate a PGP key pair that can be used to encrypt unseal keys, recovery keys or root tokens
+func generatePgpKeyPairE(name string) (*PgpKeyPair, error) {
+	// Without an explicit hash preference, encrypting to the key falls back to RIPEMD160, which isn't compiled in
+	config := &packet.Config{DefaultHash: crypto.SHA256}
+
+	entity, err := openpgp.NewEntity(name, "Vault module test", fmt.Sprintf("%s@vault.test", name), config)
+	if err != nil {
+		return nil, err
+	}
+
+	// SerializePrivate signs the identities of the entity, so it has to run before the public key is serialized
+	privateKey := bytes.NewBuffer(nil)
+	if err := entity.SerializePrivate(privateKey, config); err != nil {
+		return nil, err
+	}
+
+	publicKey := bytes.NewBuffer(nil)
+	if err := entity.Serialize(publicKey); err != nil {
+		return nil, err
+	}
+
+	return &PgpKeyPair{
+		Name:       name,
+		PublicKey:  base64.StdEncoding.EncodeToString(publicKey.Bytes()),
+		PrivateKey: base64.StdEncoding.EncodeToString(privateKey.Bytes()),
+	}, nil
+}
+
+// Generate one PGP key pair per key share
+func generatePgpKeyPairs(t *testing.T, namePrefix string, count int) []*PgpKeyPair {
+	keyPairs := []*PgpKeyPair{}
+	for i := 0; i < count; i++ {
+		keyPairs = append(keyPairs, generatePgpKeyPair(t, fmt.Sprintf("%s-%d", namePrefix, i)))
+	}
+	return keyPairs
+}
+
+// Decrypt a base64-encoded value that Vault encrypted with the public key of the given key pair
+func decryptWithPgpKey(encrypted string, keyPair *PgpKeyPair) (string, error) {
+	privateKey, err := base64.StdEncoding.DecodeString(keyPair.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode private key of PGP key pair %s: %v", keyPair.Name, err)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode value encrypted with PGP key pair %s: %v", keyPair.Name, err)
+	}
+
+	entity, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(privateKey)))
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse private key of PGP key pair %s: %v", keyPair.Name, err)
+	}
+
+	message, err := openpgp.ReadMessage(bytes.NewReader(ciphertext), openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decrypt value with PGP key pair %s: %v", keyPair.Name, err)
+	}
+
+	plaintext, err := ioutil.ReadAll(message.UnverifiedBody)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read value decrypted with PGP key pair %s: %v", keyPair.Name, err)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const RUN_VAULT_SCRIPT_PATH = "../modules/run-vault/run-vault"
+
+// Source the run-vault script and run generate_vault_config in the given config dir with the given client cert args,
+// with the GCE metadata lookup and chown stubbed out. Returns the config it wrote.
+func generateVaultConfigLocally(t *testing.T, configDir string, tlsClientCaFile string, tlsRequireAndVerifyClientCert string) string {
+	command := fmt.Sprintf(`source '%s'
+function get_instance_ip_address { echo 10.0.0.2; }
+function chown { :; }
+generate_vault_config /opt/vault/tls/vault.crt.pem /opt/vault/tls/vault.key.pem 8200 8201 '%s' vault vault-bucket "" false "" "" "" "" true '%s' '%s'`,
+		RUN_VAULT_SCRIPT_PATH, configDir, tlsClientCaFile, tlsRequireAndVerifyClientCert)
+
+	if _, err := runCommand(&LocalExecutor{}, command); err != nil {
+		t.Fatalf("Failed to run generate_vault_config: %v", err)
+	}
+	config, err := ioutil.ReadFile(filepath.Join(configDir, "default.hcl"))
+	if err != nil {
+		t.Fatalf("Failed to read the config generate_vault_config wrote: %v", err)
+	}
+	return string(config)
+}
+
+// Returns the lines of the listener block of the given Vault config, without indentation
+func getVaultListenerConfigLines(t *testing.T, config string) []string {
+	start := strings.Index(config, `listener "tcp" {`)
+	if start < 0 {
+		t.Fatalf("No listener block in Vault config:\n%s", config)
+	}
+	end := strings.Index(config[start:], "\n}")
+	if end < 0 {
+		t.Fatalf("Unterminated listener block in Vault config:\n%s", config)
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(config[start:start+end], "\n")[1:] {
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	return lines
+}
+
+func TestGenerateVaultConfigRequiresClientCert(t *testing.T) {
+	t.Parallel()
+
+	configDir, err := ioutil.TempDir("", "vault-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configDir)
+
+	config := generateVaultConfigLocally(t, configDir, "/opt/vault/tls/ca.crt.pem", "true")
+
+	expectedLines := []string{
+		`address         = "0.0.0.0:8200"`,
+		`cluster_address = "0.0.0.0:8201"`,
+		`tls_cert_file   = "/opt/vault/tls/vault.crt.pem"`,
+		`tls_key_file    = "/opt/vault/tls/vault.key.pem"`,
+		`tls_client_ca_file = "/opt/vault/tls/ca.crt.pem"`,
+		`tls_require_and_verify_client_cert = "true"`,
+	}
+	lines := getVaultListenerConfigLines(t, config)
+	if strings.Join(lines, "\n") != strings.Join(expectedLines, "\n") {
+		t.Fatalf("Expected listener config:\n%s\nbut got:\n%s", strings.Join(expectedLines, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestGenerateVaultConfigWithoutClientCert(t *testing.T) {
+	t.Parallel()
+
+	configDir, err := ioutil.TempDir("", "vault-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configDir)
+
+	// The defaults of run-vault when neither flag is set
+	config := generateVaultConfigLocally(t, configDir, "", "false")
+
+	if strings.Contains(config, "tls_client_ca_file") || strings.Contains(config, "tls_require_and_verify_client_cert") {
+		t.Fatalf("Expected no client cert settings without the flags, but got:\n%s", config)
+	}
+	if lines := getVaultListenerConfigLines(t, config); lines[len(lines)-1] != `tls_key_file    = "/opt/vault/tls/vault.key.pem"` {
+		t.Fatalf("Expected tls_key_file to end the listener block, but got:\n%s", strings.Join(lines, "\n"))
+	}
+}
@@ -0,0 +1,368 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/gcp"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/gruntwork-io/terratest/modules/test-structure"
+	compute "google.golang.org/api/compute/v1"
+)
+
+const DEFAULT_SSH_USER_NAME = "terratest"
+
+// Longer than a full run of the test suite, so the key only outlives a test that never got to revoke it by a little
+const DEFAULT_SSH_ACCESS_EXPIRY = 3 * time.Hour
+
+// The instance metadata key GCE reads SSH keys from
+const METADATA_KEY_SSH_KEYS = "ssh-keys"
+
+// The format GCE expects the expiry of an SSH key in
+const SSH_KEY_EXPIRY_FORMAT = "2006-01-02T15:04:05-0700"
+
+const SAVED_SSH_ACCESS = "SshAccess"
+
+// How to grant SSH access to a test. Fields left at their zero value fall back to the defaults.
+type SshAccessOptions struct {
+	UserName string        // Defaults to DEFAULT_SSH_USER_NAME
+	Expiry   time.Duration // Defaults to DEFAULT_SSH_ACCESS_EXPIRY
+}
+
+// SSH access of a single test to the instances of a Vault cluster and, optionally, a bastion host. Each test gets its
+// own key pair, which GCE stops accepting once it expires, even if the test never gets to revoke it.
+type SshAccess struct {
+	ProjectId         string
+	Region            string
+	InstanceGroupName string
+	ClusterSize       int
+	BastionName       string // Empty if there is no bastion host
+	UserName          string
+	KeyPair           *ssh.KeyPair
+	ExpiresAt         time.Time
+}
+
+// Generate a key pair and add it, with an expiry, to every instance in the given instance group and to the given
+// bastion host, if its name isn't empty
+func grantSshAccess(t *testing.T, projectId string, region string, instanceGroupName string, clusterSize int, bastionName string, options *SshAccessOptions) *SshAccess {
+	if options == nil {
+		options = &SshAccessOptions{}
+	}
+
+	userName := options.UserName
+	if userName == "" {
+		userName = DEFAULT_SSH_USER_NAME
+	}
+	expiry := options.Expiry
+	if expiry == 0 {
+		expiry = DEFAULT_SSH_ACCESS_EXPIRY
+	}
+
+	access := &SshAccess{
+		ProjectId:         projectId,
+		Region:            region,
+		InstanceGroupName: instanceGroupName,
+		ClusterSize:       clusterSize,
+		BastionName:       bastionName,
+		UserName:          userName,
+		KeyPair:           ssh.GenerateRSAKeyPair(t, 2048),
+		ExpiresAt:         time.Now().Add(expiry),
+	}
+
+	logger.Logf(t, "Granting SSH access for user %s until %s", access.UserName, access.ExpiresAt.Format(SSH_KEY_EXPIRY_FORMAT))
+	access.Refresh(t)
+	return access
+}
+
+// Add the key of this access to every instance that doesn't have it yet, and wait until the guest agent of each of
+// those instances has applied it. The managed instance group recreates instances from its template, which doesn't
+// have the key, so call this before SSHing to nodes after they might have been recreated.
+func (a *SshAccess) Refresh(t *testing.T) {
+	if err := a.RefreshE(t); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Like Refresh, but returns an error instead of failing the test, for stages that have to carry on without the key
+func (a *SshAccess) RefreshE(t *testing.T) error {
+	instances, err := a.getInstancesE(t)
+	if err != nil {
+		return err
+	}
+
+	updatedInstances := []*gcp.Instance{}
+	for _, instance := range instances {
+		updated, err := updateInstanceSshKeysE(t, a.ProjectId, instance.Name, func(sshKeys string) string {
+			return addSshKeyToMetadataValue(sshKeys, a.UserName, a.KeyPair.PublicKey, a.ExpiresAt)
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to grant SSH access to instance %s: %v", instance.Name, err)
+		}
+		if updated {
+			updatedInstances = append(updatedInstances, instance)
+		}
+	}
+	if len(updatedInstances) == 0 {
+		return nil
+	}
+
+	// The nodes of a private cluster are reached through the bastion host, which comes first, so wait for it first
+	bastionHost, err := a.BastionHostE(t)
+	if err != nil {
+		return err
+	}
+	for _, instance := range updatedInstances {
+		var executor Executor
+		switch {
+		case instance.Name == a.BastionName:
+			executor = newSshExecutor(*bastionHost, nil)
+		case bastionHost != nil:
+			executor = newSshExecutor(a.Host(instance.Name), bastionHost)
+		default:
+			publicIp, err := instance.GetPublicIpE(t)
+			if err != nil {
+				return err
+			}
+			executor = newSshExecutor(a.Host(publicIp), nil)
+		}
+		if err := waitForSshE(t, instance.Name, executor); err != nil {
+			return fmt.Errorf("Failed to SSH to instance %s after granting SSH access: %v", instance.Name, err)
+		}
+	}
+	return nil
+}
+
+// Returns the host to use to SSH to the instance with the given name or address with this access
+func (a *SshAccess) Host(hostname string) ssh.Host {
+	return ssh.Host{
+		Hostname:    hostname,
+		SshUserName: a.UserName,
+		SshKeyPair:  a.KeyPair,
+	}
+}
+
+// Returns the bastion host to reach the Vault nodes through with this access, or nil if there is no bastion host
+func (a *SshAccess) BastionHost(t *testing.T) *ssh.Host {
+	bastionHost, err := a.BastionHostE(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bastionHost
+}
+
+// Returns the bastion host to reach the Vault nodes through with this access, or nil if there is no bastion host
+func (a *SshAccess) BastionHostE(t *testing.T) (*ssh.Host, error) {
+	if a.BastionName == "" {
+		return nil, nil
+	}
+	bastionInstance, err := gcp.FetchInstanceE(t, a.ProjectId, a.BastionName)
+	if err != nil {
+		return nil, err
+	}
+	publicIp, err := bastionInstance.GetPublicIpE(t)
+	if err != nil {
+		return nil, err
+	}
+	bastionHost := a.Host(publicIp)
+	return &bastionHost, nil
+}
+
+// Returns the bastion host, if there is one, followed by the instances currently in the instance group
+func (a *SshAccess) getInstancesE(t *testing.T) ([]*gcp.Instance, error) {
+	instances := []*gcp.Instance{}
+	if a.BastionName != "" {
+		bastionInstance, err := gcp.FetchInstanceE(t, a.ProjectId, a.BastionName)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, bastionInstance)
+	}
+	instanceGroup, err := gcp.FetchRegionalInstanceGroupE(t, a.ProjectId, a.Region, a.InstanceGroupName)
+	if err != nil {
+		return nil, err
+	}
+	groupInstances, err := getInstancesFromGroupE(t, a.ProjectId, instanceGroup, a.ClusterSize)
+	if err != nil {
+		return nil, err
+	}
+	return append(instances, groupInstances...), nil
+}
+
+// Wait until the host the given executor runs commands on accepts our SSH key. Only connection errors are retried: if
+// the host accepts the key but `exit` fails, something else is wrong.
+func waitForSshE(t *testing.T, hostname string, executor Executor) error {
+	maxRetries := 30
+	sleepBetweenRetries := 10 * time.Second
+
+	description := fmt.Sprintf("Attempting SSH connection to %s", hostname)
+	_, err := retry.DoWithRetryE(t, description, maxRetries, sleepBetweenRetries, func() (string, error) {
+		output, err := runCommand(executor, "exit")
+		return output, retryOnlyConnectionErrors(err)
+	})
+	return err
+}
+
+// Remove the key of the given access from every instance it may have been added to. Errors are only logged, as this
+// runs at teardown and the key expires anyway.
+func revokeSshAccess(t *testing.T, access *SshAccess) {
+	// The instance group may already be gone, or only partly created, but the bastion host still has to be revoked
+	instanceNames := []string{}
+	instanceGroup, err := gcp.FetchRegionalInstanceGroupE(t, access.ProjectId, access.Region, access.InstanceGroupName)
+	if err != nil {
+		logger.Logf(t, "Failed to find instance group %s to revoke SSH access: %v", access.InstanceGroupName, err)
+	} else {
+		instances, err := instanceGroup.GetInstancesE(t, access.ProjectId)
+		if err != nil {
+			logger.Logf(t, "Failed to find instances in instance group %s to revoke SSH access: %v", access.InstanceGroupName, err)
+		}
+		for _, instance := range instances {
+			instanceNames = append(instanceNames, instance.Name)
+		}
+	}
+	if access.BastionName != "" {
+		instanceNames = append(instanceNames, access.BastionName)
+	}
+
+	for _, instanceName := range instanceNames {
+		_, err := updateInstanceSshKeysE(t, access.ProjectId, instanceName, func(sshKeys string) string {
+			return removeSshKeyFromMetadataValue(sshKeys, access.KeyPair.PublicKey)
+		})
+		if err != nil {
+			logger.Logf(t, "Failed to revoke SSH access to instance %s: %v", instanceName, err)
+			continue
+		}
+		logger.Logf(t, "Revoked SSH access for user %s to instance %s", access.UserName, instanceName)
+	}
+}
+
+// Replace the ssh-keys metadata of the given instance with the result of the given update function, and return whether
+// that changed it. The instance is fetched again on every attempt, as GCE rejects updates based on a metadata
+// fingerprint that is out of date.
+func updateInstanceSshKeysE(t *testing.T, projectId string, instanceName string, update func(sshKeys string) string) (bool, error) {
+	updated := false
+	description := fmt.Sprintf("Updating SSH keys of instance %s", instanceName)
+	_, err := retry.DoWithRetryE(t, description, 5, 5*time.Second, func() (string, error) {
+		instance, err := gcp.FetchInstanceE(t, projectId, instanceName)
+		if err != nil {
+			return "", err
+		}
+
+		metadata := instance.Metadata
+		if metadata == nil {
+			metadata = &compute.Metadata{}
+		}
+		sshKeys := getMetadataValue(metadata, METADATA_KEY_SSH_KEYS)
+		updatedSshKeys := update(sshKeys)
+		if updatedSshKeys == sshKeys {
+			return "", nil
+		}
+
+		service, err := gcp.NewInstancesServiceE(t)
+		if err != nil {
+			return "", err
+		}
+		updatedMetadata := setMetadataValue(metadata, METADATA_KEY_SSH_KEYS, updatedSshKeys)
+		if _, err := service.SetMetadata(projectId, instance.GetZone(t), instanceName, updatedMetadata).Do(); err != nil {
+			return "", err
+		}
+		updated = true
+		return "", nil
+	})
+	return updated, err
+}
+
+// Returns the value of the given metadata key, or an empty string if it isn't set
+func getMetadataValue(metadata *compute.Metadata, key string) string {
+	for _, item := range metadata.Items {
+		if item.Key == key && item.Value != nil {
+			return *item.Value
+		}
+	}
+	return ""
+}
+
+// Returns a copy of the given metadata with the given key set to the given value, keeping the fingerprint so GCE can
+// detect concurrent updates
+func setMetadataValue(metadata *compute.Metadata, key string, value string) *compute.Metadata {
+	updated := &compute.Metadata{Fingerprint: metadata.Fingerprint}
+	for _, item := range metadata.Items {
+		if item.Key != key {
+			updated.Items = append(updated.Items, item)
+		}
+	}
+	updated.Items = append(updated.Items, &compute.MetadataItems{Key: key, Value: &value})
+	return updated
+}
+
+// Format an entry of the ssh-keys metadata that GCE stops accepting after the given time, e.g.
+// `terratest:ssh-rsa AAAA... google-ssh {"userName":"terratest","expireOn":"2019-01-01T00:00:00+0000"}`
+func formatSshKeyMetadataEntry(userName string, publicKey string, expiresAt time.Time) string {
+	expiry, _ := json.Marshal(map[string]string{
+		"userName": userName,
+		"expireOn": expiresAt.UTC().Format(SSH_KEY_EXPIRY_FORMAT),
+	})
+	// The comment of the key is replaced by the google-ssh marker
+	return fmt.Sprintf("%s:%s google-ssh %s", userName, getSshKeyWithoutComment(publicKey), expiry)
+}
+
+// Returns the given ssh-keys metadata value with an entry for the given public key added, unless there already is one
+func addSshKeyToMetadataValue(sshKeys string, userName string, publicKey string, expiresAt time.Time) string {
+	key := getSshKeyWithoutComment(publicKey)
+	for _, line := range strings.Split(sshKeys, "\n") {
+		if strings.Contains(line, key) {
+			return sshKeys
+		}
+	}
+
+	entry := formatSshKeyMetadataEntry(userName, publicKey, expiresAt)
+	if strings.TrimSpace(sshKeys) == "" {
+		return entry
+	}
+	return strings.TrimRight(sshKeys, "\n") + "\n" + entry
+}
+
+// Returns the given ssh-keys metadata value without the entries for the given public key, for any user
+func removeSshKeyFromMetadataValue(sshKeys string, publicKey string) string {
+	key := getSshKeyWithoutComment(publicKey)
+	if key == "" {
+		return sshKeys
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(sshKeys, "\n") {
+		if !strings.Contains(line, key) {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the type and base64 data of the given public key in authorized_keys format, without its comment
+func getSshKeyWithoutComment(publicKey string) string {
+	keyFields := strings.Fields(publicKey)
+	if len(keyFields) > 2 {
+		keyFields = keyFields[:2]
+	}
+	return strings.Join(keyFields, " ")
+}
+
+func saveSshAccess(t *testing.T, testFolder string, access *SshAccess) {
+	test_structure.SaveTestData(t, test_structure.FormatTestDataPath(testFolder, SAVED_SSH_ACCESS), access)
+}
+
+// Returns whether an SSH access was saved for the given test folder, which it isn't if the test failed before it
+// granted one
+func isSshAccessSaved(t *testing.T, testFolder string) bool {
+	return test_structure.IsTestDataPresent(t, test_structure.FormatTestDataPath(testFolder, SAVED_SSH_ACCESS))
+}
+
+func loadSshAccess(t *testing.T, testFolder string) *SshAccess {
+	var access SshAccess
+	test_structure.LoadTestData(t, test_structure.FormatTestDataPath(testFolder, SAVED_SSH_ACCESS), &access)
+	return &access
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+const TEST_PUBLIC_KEY = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC7 terratest@example.com"
+
+func TestFormatSshKeyMetadataEntry(t *testing.T) {
+	t.Parallel()
+
+	expiresAt := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	entry := formatSshKeyMetadataEntry("vault-test", TEST_PUBLIC_KEY, expiresAt)
+
+	expected := `vault-test:ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC7 google-ssh {"expireOn":"2019-01-02T03:04:05+0000","userName":"vault-test"}`
+	if entry != expected {
+		t.Fatalf("Expected entry %q, but got %q", expected, entry)
+	}
+}
+
+func TestAddAndRemoveSshKeyFromMetadataValue(t *testing.T) {
+	t.Parallel()
+
+	existing := "admin:ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA admin"
+	expiresAt := time.Now().Add(time.Hour)
+
+	added := addSshKeyToMetadataValue(existing, "terratest", TEST_PUBLIC_KEY, expiresAt)
+	lines := strings.Split(added, "\n")
+	if len(lines) != 2 || lines[0] != existing || !strings.HasPrefix(lines[1], "terratest:ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC7 google-ssh ") {
+		t.Fatalf("Expected the key to be added after the existing one, but got: %q", added)
+	}
+
+	// A recreated instance that still has the key, e.g. with an older expiry, doesn't get it twice
+	if addedAgain := addSshKeyToMetadataValue(added, "terratest", TEST_PUBLIC_KEY, expiresAt.Add(time.Hour)); addedAgain != added {
+		t.Fatalf("Expected adding the key again to change nothing, but got: %q", addedAgain)
+	}
+
+	if removed := removeSshKeyFromMetadataValue(added, TEST_PUBLIC_KEY); removed != existing {
+		t.Fatalf("Expected only the existing key to be left, but got: %q", removed)
+	}
+	if removed := removeSshKeyFromMetadataValue(existing, ""); removed != existing {
+		t.Fatalf("Expected removing an empty key to change nothing, but got: %q", removed)
+	}
+}
+
+func TestSetMetadataValueKeepsOtherItemsAndFingerprint(t *testing.T) {
+	t.Parallel()
+
+	startupScript := "#!/bin/bash"
+	oldSshKeys := "admin:ssh-rsa AAAA admin"
+	metadata := &compute.Metadata{
+		Fingerprint: "abc",
+		Items: []*compute.MetadataItems{
+			{Key: "startup-script", Value: &startupScript},
+			{Key: METADATA_KEY_SSH_KEYS, Value: &oldSshKeys},
+		},
+	}
+
+	updated := setMetadataValue(metadata, METADATA_KEY_SSH_KEYS, "")
+	if updated.Fingerprint != "abc" || len(updated.Items) != 2 {
+		t.Fatalf("Expected the fingerprint and both items to be kept, but got: %+v", updated)
+	}
+	if getMetadataValue(updated, "startup-script") != startupScript || getMetadataValue(updated, METADATA_KEY_SSH_KEYS) != "" {
+		t.Fatalf("Unexpected metadata after update: %+v", updated.Items)
+	}
+	if getMetadataValue(metadata, METADATA_KEY_SSH_KEYS) != oldSshKeys {
+		t.Fatal("Expected the original metadata to be left unchanged")
+	}
+}
+
+func TestWaitForSshRetriesUntilKeyIsAccepted(t *testing.T) {
+	t.Parallel()
+
+	// The guest agent hasn't applied the key yet on the first attempt
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^exit$`, Err: &ConnectionError{Hostname: "vault-node-0", Err: fmt.Errorf("ssh: unable to authenticate")}},
+		{Match: `^exit$`},
+	}}
+
+	if err := waitForSshE(t, "vault-node-0", executor); err != nil {
+		t.Fatalf("Expected to wait until the node accepts the key, but got: %v", err)
+	}
+	if err := executor.CheckScriptDone(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForSshDoesNotRetryFailedCommand(t *testing.T) {
+	t.Parallel()
+
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^exit$`, Stderr: "/bin/sh: not found", ExitCode: 127},
+	}}
+
+	if err := waitForSshE(t, "vault-node-0", executor); err == nil {
+		t.Fatal("Expected an error when the node accepts the key but the command fails")
+	}
+	if len(executor.Commands) != 1 {
+		t.Fatalf("Expected the command to run once, but it ran %d times", len(executor.Commands))
+	}
+}
+
+func TestRefreshSshAccessWithoutAccess(t *testing.T) {
+	t.Parallel()
+
+	// Clusters loaded from disk or set up with fake executors have no SSH access to refresh
+	cluster := &VaultCluster{}
+	cluster.RefreshSshAccess(t)
+}
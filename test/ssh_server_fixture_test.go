@@ -0,0 +1,210 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+const TEST_SSH_USER_NAME = "terratest"
+
+// An SSH server running in the test process. It only accepts the given user and key pair, and runs every command it
+// receives on its backend Executor, which is usually a FakeExecutor with scripted output. It also forwards TCP
+// connections, so it can be used as a jump host for another TestSshServer.
+type TestSshServer struct {
+	Host ssh.Host
+	Port int
+
+	backend  Executor
+	config   *cryptossh.ServerConfig
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// Start an SSH server on a random local port that accepts the given key pair for TEST_SSH_USER_NAME and runs commands
+// on the given backend. Call Stop when done with it.
+func startTestSshServer(t *testing.T, keyPair *ssh.KeyPair, backend Executor) *TestSshServer {
+	authorizedKey, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(keyPair.PublicKey))
+	if err != nil {
+		t.Fatalf("Failed to parse public key of key pair: %v", err)
+	}
+
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate SSH host key: %v", err)
+	}
+	hostSigner, err := cryptossh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("Failed to create SSH host key signer: %v", err)
+	}
+
+	config := &cryptossh.ServerConfig{
+		PublicKeyCallback: func(conn cryptossh.ConnMetadata, key cryptossh.PublicKey) (*cryptossh.Permissions, error) {
+			if conn.User() == TEST_SSH_USER_NAME && string(key.Marshal()) == string(authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Unknown public key for user %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen for SSH connections: %v", err)
+	}
+
+	server := &TestSshServer{
+		Host: ssh.Host{
+			Hostname:    "127.0.0.1",
+			SshUserName: TEST_SSH_USER_NAME,
+			SshKeyPair:  keyPair,
+		},
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		backend:  backend,
+		config:   config,
+		listener: listener,
+	}
+
+	server.wg.Add(1)
+	go server.acceptConnections()
+
+	return server
+}
+
+// Returns the hop to use to reach this server with a MultiHopSshExecutor
+func (s *TestSshServer) Hop() SshHop {
+	return SshHop{Host: s.Host, Port: s.Port}
+}
+
+// Stop accepting connections and wait for the open ones to be handled
+func (s *TestSshServer) Stop() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *TestSshServer) acceptConnections() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+func (s *TestSshServer) handleConnection(conn net.Conn) {
+	serverConn, channels, requests, err := cryptossh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	go cryptossh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			go s.handleSession(newChannel)
+		case "direct-tcpip":
+			go s.handleDirectTcpip(newChannel)
+		default:
+			newChannel.Reject(cryptossh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// Run the command of an exec request on the backend, and return its stdout, stderr and exit status like sshd would
+func (s *TestSshServer) handleSession(newChannel cryptossh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := cryptossh.Unmarshal(request.Payload, &payload); err != nil {
+			request.Reply(false, nil)
+			continue
+		}
+		request.Reply(true, nil)
+
+		result, err := s.backend.Exec(payload.Command)
+
+		exitStatus := 0
+		if result != nil {
+			io.WriteString(channel, result.Stdout)
+			io.WriteString(channel.Stderr(), result.Stderr)
+			exitStatus = result.ExitCode
+		} else if err != nil {
+			io.WriteString(channel.Stderr(), err.Error())
+			exitStatus = 1
+		}
+
+		status := make([]byte, 4)
+		binary.BigEndian.PutUint32(status, uint32(exitStatus))
+		channel.SendRequest("exit-status", false, status)
+		return
+	}
+}
+
+// Forward a TCP connection to the requested address, like sshd does for jump hosts and port forwarding
+func (s *TestSshServer) handleDirectTcpip(newChannel cryptossh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := cryptossh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(cryptossh.ConnectionFailed, "invalid direct-tcpip payload")
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newChannel.Reject(cryptossh.ConnectionFailed, err.Error())
+		return
+	}
+	defer target.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go cryptossh.DiscardRequests(requests)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, channel)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(channel, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,191 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/hashicorp/vault/api"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// A local port forwarded through SSH to an address the last hop can reach, like `ssh -L`. Close it when done with it.
+type SshTunnel struct {
+	LocalAddress  string // The host:port to connect to on the machine running the test
+	RemoteAddress string // The host:port the last hop connects to
+
+	clients   []*cryptossh.Client
+	listener  net.Listener
+	wg        sync.WaitGroup
+	once      sync.Once
+	mutex     sync.Mutex
+	lastError error
+}
+
+// Open a tunnel through SSH to port 8200 of the given Vault node. If there's a bastion host, the tunnel goes through
+// it to the node, so nodes without a public address can be reached. Otherwise, it goes through the node itself.
+func openVaultTunnel(t *testing.T, node ssh.Host, bastionHost *ssh.Host) *SshTunnel {
+	tunnel, err := openVaultTunnelE(node, bastionHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Logf(t, "Opened SSH tunnel from %s to %s on host %s", tunnel.LocalAddress, tunnel.RemoteAddress, node.Hostname)
+	return tunnel
+}
+
+// Open a tunnel through SSH to port 8200 of the given Vault node, through the given bastion host if there is one
+func openVaultTunnelE(node ssh.Host, bastionHost *ssh.Host) (*SshTunnel, error) {
+	hops := []SshHop{{Host: node}}
+	remoteAddress := net.JoinHostPort("127.0.0.1", strconv.Itoa(VAULT_PORT))
+	if bastionHost != nil {
+		hops = []SshHop{{Host: *bastionHost}}
+		remoteAddress = net.JoinHostPort(node.Hostname, strconv.Itoa(VAULT_PORT))
+	}
+
+	tunnel, err := openSshTunnelE(hops, remoteAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open SSH tunnel to Vault on host %s: %v", node.Hostname, err)
+	}
+	return tunnel, nil
+}
+
+// Open a tunnel from a random local port through the given SSH hops to the given remote address
+func openSshTunnelE(hops []SshHop, remoteAddress string) (*SshTunnel, error) {
+	clients, err := dialSshHops(hops)
+	if err != nil {
+		closeSshClients(clients)
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		closeSshClients(clients)
+		return nil, fmt.Errorf("Failed to listen for tunnel connections: %v", err)
+	}
+
+	tunnel := &SshTunnel{
+		LocalAddress:  listener.Addr().String(),
+		RemoteAddress: remoteAddress,
+		clients:       clients,
+		listener:      listener,
+	}
+
+	tunnel.wg.Add(1)
+	go tunnel.acceptConnections()
+
+	return tunnel, nil
+}
+
+// Stop accepting connections, close the open ones and the SSH connections of the tunnel. It's safe to call more than
+// once.
+func (tunnel *SshTunnel) Close() {
+	tunnel.once.Do(func() {
+		tunnel.listener.Close()
+		closeSshClients(tunnel.clients)
+		tunnel.wg.Wait()
+	})
+}
+
+// Returns the last error the tunnel got connecting to the remote address, or nil if it didn't get any. The local side
+// only sees its connection close when that fails, so this is where to look when a client of the tunnel gets an EOF.
+func (tunnel *SshTunnel) LastError() error {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.lastError
+}
+
+// Returns the given error of a client of the tunnel with the last error of the tunnel added, if it got one
+func (tunnel *SshTunnel) withLastError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if tunnelErr := tunnel.LastError(); tunnelErr != nil {
+		return fmt.Errorf("%v. Last error of the SSH tunnel: %v", err, tunnelErr)
+	}
+	return err
+}
+
+func (tunnel *SshTunnel) acceptConnections() {
+	defer tunnel.wg.Done()
+
+	for {
+		localConn, err := tunnel.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		tunnel.wg.Add(1)
+		go func() {
+			defer tunnel.wg.Done()
+			tunnel.forward(localConn)
+		}()
+	}
+}
+
+// Copy data both ways between the given local connection and a new connection to the remote address, until either
+// side closes
+func (tunnel *SshTunnel) forward(localConn net.Conn) {
+	defer localConn.Close()
+
+	remoteConn, err := tunnel.clients[len(tunnel.clients)-1].Dial("tcp", tunnel.RemoteAddress)
+	if err != nil {
+		tunnel.mutex.Lock()
+		defer tunnel.mutex.Unlock()
+		tunnel.lastError = fmt.Errorf("Failed to connect to %s: %v", tunnel.RemoteAddress, err)
+		return
+	}
+	defer remoteConn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remoteConn, localConn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(localConn, remoteConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Create a Vault client that talks to Vault through the given tunnel and verifies its cert with the given TLS config
+func createVaultTunnelClient(t *testing.T, tunnel *SshTunnel, tlsConfig *api.TLSConfig) *api.Client {
+	return createVaultClientForAddress(t, fmt.Sprintf("https://%s", tunnel.LocalAddress), tlsConfig)
+}
+
+// Use the typed Vault API through an SSH tunnel to the active node of the given cluster, and check that the node says
+// it's the leader and that the root token of the cluster has the root policy
+func testVaultApiThroughTunnel(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) {
+	cluster.RefreshSshAccess(t)
+
+	activeNode := cluster.GetActiveNode(t, bastionHost)
+	tunnel := openVaultTunnel(t, activeNode, bastionHost)
+	defer tunnel.Close()
+
+	client := createVaultTunnelClient(t, tunnel, getDefaultVaultTlsConfig(t))
+	assertVaultClientIsLeaderWithRootToken(t, client, cluster.RootToken)
+}
+
+// Check through the given client that the Vault node it talks to is the leader and that the given token has the root
+// policy
+func assertVaultClientIsLeaderWithRootToken(t *testing.T, client *api.Client, rootToken string) {
+	leader, err := client.Sys().Leader()
+	if err != nil {
+		t.Fatalf("Failed to read the leader from Vault at %s: %v", client.Address(), err)
+	}
+	if !leader.IsSelf {
+		t.Fatalf("Expected Vault at %s to be the leader, but the leader is %s", client.Address(), leader.LeaderAddress)
+	}
+
+	client.SetToken(rootToken)
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		t.Fatalf("Failed to look up token on Vault at %s: %v", client.Address(), err)
+	}
+	assertSecretHasRootPolicy(t, secret)
+}
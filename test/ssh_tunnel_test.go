@@ -0,0 +1,169 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/hashicorp/vault/api"
+)
+
+// Start a TLS server that answers the Vault API requests of assertVaultClientIsLeaderWithRootToken like the active
+// node would. Close it when done with it.
+func startTestVaultApiServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/leader":
+			fmt.Fprint(w, `{"ha_enabled":true,"is_self":true,"leader_address":"https://vault-node-0:8200"}`)
+		case "/v1/auth/token/lookup-self":
+			if r.Header.Get("X-Vault-Token") != "root-token" {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"errors":["permission denied"]}`)
+				return
+			}
+			fmt.Fprint(w, `{"data":{"policies":["root"]}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// Write the self-signed cert of the given test server to a temp file, so clients can trust it like a CA
+func writeTestServerCACert(t *testing.T, server *httptest.Server) string {
+	path, err := writePemToTempFile("test-server-ca", "CERTIFICATE", server.Certificate().Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSshTunnelReachesVaultApiThroughTestServer(t *testing.T) {
+	t.Parallel()
+
+	vault := startTestVaultApiServer()
+	defer vault.Close()
+	caCertPath := writeTestServerCACert(t, vault)
+	defer os.Remove(caCertPath)
+
+	server := startTestSshServer(t, ssh.GenerateRSAKeyPair(t, 2048), &FakeExecutor{Host: "bastion"})
+	defer server.Stop()
+
+	tunnel, err := openSshTunnelE([]SshHop{server.Hop()}, vault.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to open SSH tunnel: %v", err)
+	}
+	defer tunnel.Close()
+
+	// The cert of the test server is valid for example.com, like the cert of the Vault nodes is for vault.service.consul
+	tlsConfig := &api.TLSConfig{CACert: caCertPath, TLSServerName: "example.com"}
+	assertVaultClientIsLeaderWithRootToken(t, createVaultTunnelClient(t, tunnel, tlsConfig), "root-token")
+}
+
+func TestVaultClientVerifiesServerCert(t *testing.T) {
+	t.Parallel()
+
+	vault := startTestVaultApiServer()
+	defer vault.Close()
+	caCertPath := writeTestServerCACert(t, vault)
+	defer os.Remove(caCertPath)
+	otherTlsCert := generateSelfSignedTlsCert(t)
+	defer cleanupTLSCertFiles(otherTlsCert)
+
+	invalidTlsConfigs := map[string]*api.TLSConfig{
+		"an unknown CA":      {CACert: otherTlsCert.CAPublicKeyPath, TLSServerName: "example.com"},
+		"a wrong SAN":        {CACert: caCertPath, TLSServerName: VAULT_TLS_SERVER_NAME},
+		"the system CA pool": {TLSServerName: "example.com"},
+	}
+	for description, tlsConfig := range invalidTlsConfigs {
+		client := createVaultClientForAddress(t, vault.URL, tlsConfig)
+		client.SetMaxRetries(0)
+		if _, err := client.Sys().Leader(); err == nil {
+			t.Errorf("Expected a client that verifies the cert against %s to fail", description)
+		}
+	}
+
+	client := createVaultClientForAddress(t, vault.URL, &api.TLSConfig{Insecure: true})
+	if _, err := client.Sys().Leader(); err != nil {
+		t.Fatalf("Expected a client that skips verification explicitly to succeed, but got: %v", err)
+	}
+}
+
+func TestSshTunnelStopsListeningWhenClosed(t *testing.T) {
+	t.Parallel()
+
+	server := startTestSshServer(t, ssh.GenerateRSAKeyPair(t, 2048), &FakeExecutor{Host: "bastion"})
+	defer server.Stop()
+
+	tunnel, err := openSshTunnelE([]SshHop{server.Hop()}, "127.0.0.1:8200")
+	if err != nil {
+		t.Fatalf("Failed to open SSH tunnel: %v", err)
+	}
+	tunnel.Close()
+	tunnel.Close()
+
+	if conn, err := net.Dial("tcp", tunnel.LocalAddress); err == nil {
+		conn.Close()
+		t.Fatalf("Expected %s to stop accepting connections after the tunnel was closed", tunnel.LocalAddress)
+	}
+}
+
+func TestSshTunnelRecordsErrorWhenRemoteAddressCannotBeReached(t *testing.T) {
+	t.Parallel()
+
+	server := startTestSshServer(t, ssh.GenerateRSAKeyPair(t, 2048), &FakeExecutor{Host: "bastion"})
+	defer server.Stop()
+
+	// Find a port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteAddress := listener.Addr().String()
+	listener.Close()
+
+	tunnel, err := openSshTunnelE([]SshHop{server.Hop()}, remoteAddress)
+	if err != nil {
+		t.Fatalf("Failed to open SSH tunnel: %v", err)
+	}
+	defer tunnel.Close()
+
+	if tunnel.LastError() != nil {
+		t.Fatalf("Expected no error before the tunnel is used, but got: %v", tunnel.LastError())
+	}
+
+	conn, err := net.Dial("tcp", tunnel.LocalAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("Expected the tunnel to close the local connection, but got: %v", err)
+	}
+
+	if err := tunnel.LastError(); err == nil || !strings.Contains(err.Error(), remoteAddress) {
+		t.Fatalf("Expected the tunnel to record that it couldn't connect to %s, but got: %v", remoteAddress, err)
+	}
+	if err := tunnel.withLastError(fmt.Errorf("EOF")); !strings.Contains(err.Error(), "EOF. Last error of the SSH tunnel: Failed to connect to "+remoteAddress) {
+		t.Fatalf("Expected the error of the client to include the error of the tunnel, but got: %v", err)
+	}
+}
+
+func TestOpenSshTunnelFailsWithUnknownKeyPair(t *testing.T) {
+	t.Parallel()
+
+	server := startTestSshServer(t, ssh.GenerateRSAKeyPair(t, 2048), &FakeExecutor{Host: "bastion"})
+	defer server.Stop()
+
+	hop := server.Hop()
+	hop.Host.SshKeyPair = ssh.GenerateRSAKeyPair(t, 2048)
+
+	if _, err := openSshTunnelE([]SshHop{hop}, "127.0.0.1:8200"); err == nil {
+		t.Fatal("Expected opening a tunnel with an unknown key pair to fail")
+	}
+}
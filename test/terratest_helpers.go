@@ -34,7 +34,8 @@ const PACKER_VAR_VAULT_DOWNLOAD_URL = "VAULT_DOWNLOAD_URL"
 const PACKER_TEMPLATE_PATH = "../examples/vault-consul-image/vault-consul.json"
 
 const SAVED_TLS_CERT = "TlsCert"
-const SAVED_KEYPAIR = "KeyPair"
+const SAVED_VAULT_CLUSTER = "VaultCluster"
+const SAVED_BASTION_HOST = "BastionHost"
 
 // Checks if a required environment variable is set
 func getUrlFromEnv(t *testing.T, key string) string {
@@ -86,32 +87,30 @@ func loadTLSCert(t *testing.T, testFolder string) TlsCert {
 	return tlsCert
 }
 
-func saveKeyPair(t *testing.T, testFolder string, keyPair *ssh.KeyPair) {
-	test_structure.SaveTestData(t, test_structure.FormatTestDataPath(testFolder, SAVED_KEYPAIR), keyPair)
+func saveVaultCluster(t *testing.T, testFolder string, cluster *VaultCluster) {
+	test_structure.SaveTestData(t, test_structure.FormatTestDataPath(testFolder, SAVED_VAULT_CLUSTER), cluster)
 }
 
-func loadKeyPair(t *testing.T, testFolder string) ssh.KeyPair {
-	var keyPair ssh.KeyPair
-	test_structure.LoadTestData(t, test_structure.FormatTestDataPath(testFolder, SAVED_KEYPAIR), &keyPair)
-	return keyPair
+// Returns whether a Vault cluster was saved for the given test folder, which it isn't if the deploy stage failed before
+// the cluster was initialized
+func isVaultClusterSaved(t *testing.T, testFolder string) bool {
+	return test_structure.IsTestDataPresent(t, test_structure.FormatTestDataPath(testFolder, SAVED_VAULT_CLUSTER))
 }
 
-func getFilesFromInstance(t *testing.T, instance *gcp.Instance, keyPair *ssh.KeyPair, filePaths ...string) map[string]string {
-	publicIp := instance.GetPublicIp(t)
-
-	host := ssh.Host{
-		SshUserName: "terratest",
-		SshKeyPair:  keyPair,
-		Hostname:    publicIp,
-	}
+func loadVaultCluster(t *testing.T, testFolder string) *VaultCluster {
+	var cluster VaultCluster
+	test_structure.LoadTestData(t, test_structure.FormatTestDataPath(testFolder, SAVED_VAULT_CLUSTER), &cluster)
+	return &cluster
+}
 
-	useSudo := false
-	filesFromtInstance, err := ssh.FetchContentsOfFilesE(t, host, useSudo, filePaths...)
-	if err != nil {
-		logger.Logf(t, fmt.Sprintf("Error getting log file from instance: %s", err.Error()))
-	}
+func saveBastionHost(t *testing.T, testFolder string, bastionHost *ssh.Host) {
+	test_structure.SaveTestData(t, test_structure.FormatTestDataPath(testFolder, SAVED_BASTION_HOST), bastionHost)
+}
 
-	return filesFromtInstance
+func loadBastionHost(t *testing.T, testFolder string) *ssh.Host {
+	var bastionHost ssh.Host
+	test_structure.LoadTestData(t, test_structure.FormatTestDataPath(testFolder, SAVED_BASTION_HOST), &bastionHost)
+	return &bastionHost
 }
 
 func writeLogFile(t *testing.T, buffer string, destination string) {
@@ -125,21 +124,23 @@ func writeLogFile(t *testing.T, buffer string, destination string) {
 	file.WriteString(buffer)
 }
 
-func addKeyPairToInstancesInGroup(t *testing.T, projectId string, region string, instanceGroupName string, keyPair *ssh.KeyPair, sshUserName string, expectedInstances int) []*gcp.Instance {
-	instanceGroup := gcp.FetchRegionalInstanceGroup(t, projectId, region, instanceGroupName)
-	instances := getInstancesFromGroup(t, projectId, instanceGroup, expectedInstances)
-
-	for _, instance := range instances {
-		instance.AddSshKey(t, sshUserName, keyPair.PublicKey)
+func getInstancesFromGroup(t *testing.T, projectId string, instanceGroup *gcp.RegionalInstanceGroup, expectedInstances int) []*gcp.Instance {
+	instances, err := getInstancesFromGroupE(t, projectId, instanceGroup, expectedInstances)
+	if err != nil {
+		t.Fatal(err)
 	}
 	return instances
 }
 
-func getInstancesFromGroup(t *testing.T, projectId string, instanceGroup *gcp.RegionalInstanceGroup, expectedInstances int) []*gcp.Instance {
+func getInstancesFromGroupE(t *testing.T, projectId string, instanceGroup *gcp.RegionalInstanceGroup, expectedInstances int) ([]*gcp.Instance, error) {
 	instances := []*gcp.Instance{}
 
-	retry.DoWithRetry(t, "Getting instances", 30, 10*time.Second, func() (string, error) {
-		instances = instanceGroup.GetInstances(t, projectId)
+	_, err := retry.DoWithRetryE(t, "Getting instances", 30, 10*time.Second, func() (string, error) {
+		var err error
+		instances, err = instanceGroup.GetInstancesE(t, projectId)
+		if err != nil {
+			return "", err
+		}
 
 		if len(instances) != expectedInstances {
 			return "", fmt.Errorf("Expected to get %d instances, but got %d: %v", expectedInstances, len(instances), instances)
@@ -147,14 +148,7 @@ func getInstancesFromGroup(t *testing.T, projectId string, instanceGroup *gcp.Re
 		return "", nil
 	})
 
-	return instances
-}
-
-func runCommand(t *testing.T, bastionHost *ssh.Host, targetHost *ssh.Host, command string) (string, error) {
-	if bastionHost == nil {
-		return ssh.CheckSshCommandE(t, *targetHost, command)
-	}
-	return ssh.CheckPrivateSshConnectionE(t, *bastionHost, *targetHost, command)
+	return instances, err
 }
 
 func getRandomCidr() string {
@@ -1,116 +1,437 @@
 package test
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
-	"os/user"
-	"strings"
 	"testing"
-
-	"github.com/gruntwork-io/terratest/modules/terraform"
-	"github.com/gruntwork-io/terratest/modules/test-structure"
+	"time"
 )
 
-//
-// This file was copy and pasted verbatim from https://github.com/hashicorp/terraform-aws-vault/blob/master/test/tls_helpers.go
-//
-
 type TlsCert struct {
-	CAPublicKeyPath string
-	PublicKeyPath   string
-	PrivateKeyPath  string
+	CAPublicKeyPath  string
+	CAPrivateKeyPath string // Only used to issue client certs, it isn't copied to the Vault images
+	PublicKeyPath    string
+	PrivateKeyPath   string
+}
+
+// A client cert issued by the CA of a TlsCert, for a Vault listener that requires clients to present one
+type ClientTlsCert struct {
+	PublicKeyPath  string
+	PrivateKeyPath string
+}
+
+// The knobs of the private-tls-cert module, so the tests generate the same kind of certs our users do. Use
+// getDefaultTlsCertOptions to get the values the tests use, and change the ones a test cares about.
+type TlsCertOptions struct {
+	OrganizationName     string
+	CACommonName         string
+	CommonName           string
+	DnsNames             []string
+	IpAddresses          []string
+	ValidityPeriodHours  int
+	PrivateKeyAlgorithm  string // RSA or ECDSA
+	PrivateKeyEcdsaCurve string // P224, P256, P384 or P521. Only used for ECDSA.
+	PrivateKeyRsaBits    int    // Only used for RSA
+	CAAllowedUses        []string
+	AllowedUses          []string
+}
+
+// The allowed uses of the tls provider of Terraform, which the private-tls-cert module passes through, and the key
+// usages they stand for. From: https://www.terraform.io/docs/providers/tls/r/self_signed_cert.html#allowed_uses
+var tlsKeyUsages = map[string]x509.KeyUsage{
+	"digital_signature":  x509.KeyUsageDigitalSignature,
+	"content_commitment": x509.KeyUsageContentCommitment,
+	"key_encipherment":   x509.KeyUsageKeyEncipherment,
+	"data_encipherment":  x509.KeyUsageDataEncipherment,
+	"key_agreement":      x509.KeyUsageKeyAgreement,
+	"cert_signing":       x509.KeyUsageCertSign,
+	"crl_signing":        x509.KeyUsageCRLSign,
+	"encipher_only":      x509.KeyUsageEncipherOnly,
+	"decipher_only":      x509.KeyUsageDecipherOnly,
 }
 
-const REPO_ROOT = "../"
+var tlsExtKeyUsages = map[string]x509.ExtKeyUsage{
+	"any_extended":                  x509.ExtKeyUsageAny,
+	"server_auth":                   x509.ExtKeyUsageServerAuth,
+	"client_auth":                   x509.ExtKeyUsageClientAuth,
+	"code_signing":                  x509.ExtKeyUsageCodeSigning,
+	"email_protection":              x509.ExtKeyUsageEmailProtection,
+	"ipsec_end_system":              x509.ExtKeyUsageIPSECEndSystem,
+	"ipsec_tunnel":                  x509.ExtKeyUsageIPSECTunnel,
+	"ipsec_user":                    x509.ExtKeyUsageIPSECUser,
+	"timestamping":                  x509.ExtKeyUsageTimeStamping,
+	"ocsp_signing":                  x509.ExtKeyUsageOCSPSigning,
+	"microsoft_server_gated_crypto": x509.ExtKeyUsageMicrosoftServerGatedCrypto,
+	"netscape_server_gated_crypto":  x509.ExtKeyUsageNetscapeServerGatedCrypto,
+}
 
-const PRIVATE_TLS_CERT_PATH = "modules/private-tls-cert"
+var ecdsaCurves = map[string]elliptic.Curve{
+	"P224": elliptic.P224(),
+	"P256": elliptic.P256(),
+	"P384": elliptic.P384(),
+	"P521": elliptic.P521(),
+}
 
-const VAR_CA_PUBLIC_KEY_FILE_PATH = "ca_public_key_file_path"
-const VAR_PUBLIC_KEY_FILE_PATH = "public_key_file_path"
-const VAR_PRIVATE_KEY_FILE_PATH = "private_key_file_path"
-const VAR_OWNER = "owner"
-const VAR_ORGANIZATION_NAME = "organization_name"
-const VAR_CA_COMMON_NAME = "ca_common_name"
-const VAR_COMMON_NAME = "common_name"
-const VAR_DNS_NAMES = "dns_names"
-const VAR_IP_ADDRESSES = "ip_addresses"
-const VAR_VALIDITY_PERIOD_HOURS = "validity_period_hours"
+// Returns the options the tests use for the cert baked into the Vault images, with the defaults of the
+// private-tls-cert module for the optional variables
+func getDefaultTlsCertOptions() *TlsCertOptions {
+	return &TlsCertOptions{
+		OrganizationName:     "Gruntwork",
+		CACommonName:         "Vault Module Test CA",
+		CommonName:           "Vault Module Test",
+		DnsNames:             []string{"vault.service.consul"},
+		IpAddresses:          []string{"127.0.0.1"},
+		ValidityPeriodHours:  1000,
+		PrivateKeyAlgorithm:  "RSA",
+		PrivateKeyEcdsaCurve: "P256",
+		PrivateKeyRsaBits:    2048,
+		CAAllowedUses:        []string{"cert_signing", "key_encipherment", "digital_signature"},
+		AllowedUses:          []string{"key_encipherment", "digital_signature"},
+	}
+}
 
-// Use the private-tls-cert module to generate a self-signed TLS certificate
+// Generate a self-signed TLS certificate like the private-tls-cert module does with the options the tests use
 func generateSelfSignedTlsCert(t *testing.T) TlsCert {
+	return generateTlsCert(t, getDefaultTlsCertOptions())
+}
+
+// Generate a CA and a TLS certificate signed by it with the given options, like the private-tls-cert module does, and
+// write them to temp files
+func generateTlsCert(t *testing.T, options *TlsCertOptions) TlsCert {
 	t.Logf("Generating self-signed TLS certs")
 
-	currentUser, err := user.Current()
+	tlsCert, err := generateTlsCertE(options)
+	if err != nil {
+		t.Fatalf("Failed to generate TLS certs: %v", err)
+	}
+	return tlsCert
+}
+
+// Generate a CA and a TLS certificate signed by it with the given options, like the private-tls-cert module does, and
+// write them to temp files
+func generateTlsCertE(options *TlsCertOptions) (TlsCert, error) {
+	caKeyUsage, caExtKeyUsage, err := parseTlsAllowedUses(options.CAAllowedUses)
+	if err != nil {
+		return TlsCert{}, err
+	}
+
+	caKey, err := generateTlsPrivateKey(options)
+	if err != nil {
+		return TlsCert{}, err
+	}
+	caTemplate, err := newTlsCertTemplate(options, options.CACommonName, caKeyUsage, caExtKeyUsage)
+	if err != nil {
+		return TlsCert{}, err
+	}
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.SubjectKeyId, err = getSubjectKeyId(caKey.Public())
+	if err != nil {
+		return TlsCert{}, err
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		return TlsCert{}, fmt.Errorf("Failed to create CA certificate: %v", err)
+	}
+	caKeyPem, err := encodeTlsPrivateKeyPem(caKey)
+	if err != nil {
+		return TlsCert{}, err
+	}
+
+	der, keyPem, err := issueTlsCertE(options, caTemplate, caKey)
 	if err != nil {
-		t.Fatalf("Couldn't get current OS user: %v", err)
+		return TlsCert{}, err
+	}
+
+	tlsCert := TlsCert{}
+	if tlsCert.CAPublicKeyPath, err = writePemToTempFile("ca-public-key", "CERTIFICATE", caDer); err != nil {
+		return TlsCert{}, err
 	}
+	if tlsCert.CAPrivateKeyPath, err = writePemToTempFile("ca-private-key", caKeyPem.Type, caKeyPem.Bytes); err != nil {
+		cleanupTLSCertFiles(tlsCert)
+		return TlsCert{}, err
+	}
+	if tlsCert.PublicKeyPath, err = writePemToTempFile("tls-public-key", "CERTIFICATE", der); err != nil {
+		cleanupTLSCertFiles(tlsCert)
+		return TlsCert{}, err
+	}
+	if tlsCert.PrivateKeyPath, err = writePemToTempFile("tls-private-key", keyPem.Type, keyPem.Bytes); err != nil {
+		cleanupTLSCertFiles(tlsCert)
+		return TlsCert{}, err
+	}
+	return tlsCert, nil
+}
+
+// Returns the options for a client cert with the given common name, with the key settings of the private-tls-cert
+// module and the client_auth use, which Vault requires of the certs clients present
+func getDefaultClientTlsCertOptions(commonName string) *TlsCertOptions {
+	options := getDefaultTlsCertOptions()
+	options.CommonName = commonName
+	options.DnsNames = nil
+	options.IpAddresses = nil
+	options.AllowedUses = []string{"key_encipherment", "digital_signature", "client_auth"}
+	return options
+}
+
+// Issue a client cert with the given common name from the CA of the given cert and write it to temp files
+func generateClientTlsCert(t *testing.T, caTlsCert TlsCert, commonName string) ClientTlsCert {
+	t.Logf("Generating TLS client cert for %s", commonName)
 
-	caPublicKeyFilePath, err := ioutil.TempFile("", "ca-public-key")
+	clientTlsCert, err := generateClientTlsCertE(caTlsCert, getDefaultClientTlsCertOptions(commonName))
 	if err != nil {
-		t.Fatalf("Couldn't create temp file: %v", err)
+		t.Fatalf("Failed to generate TLS client cert: %v", err)
 	}
+	return clientTlsCert
+}
 
-	publicKeyFilePath, err := ioutil.TempFile("", "tls-public-key")
+// Issue a client cert with the given options from the CA of the given cert and write it to temp files. Only the
+// common name, validity, key and allowed uses in the options are used.
+func generateClientTlsCertE(caTlsCert TlsCert, options *TlsCertOptions) (ClientTlsCert, error) {
+	caCert, err := loadCertificateE(caTlsCert.CAPublicKeyPath)
+	if err != nil {
+		return ClientTlsCert{}, err
+	}
+	caKey, err := loadTlsPrivateKeyE(caTlsCert.CAPrivateKeyPath)
 	if err != nil {
-		t.Fatalf("Couldn't create temp file: %v", err)
+		return ClientTlsCert{}, err
 	}
 
-	privateKeyFilePath, err := ioutil.TempFile("", "tls-private-key")
+	der, keyPem, err := issueTlsCertE(options, caCert, caKey)
 	if err != nil {
-		t.Fatalf("Couldn't create temp file: %v", err)
+		return ClientTlsCert{}, err
 	}
 
-	examplesDir := test_structure.CopyTerraformFolderToTemp(t, REPO_ROOT, PRIVATE_TLS_CERT_PATH)
+	clientTlsCert := ClientTlsCert{}
+	if clientTlsCert.PublicKeyPath, err = writePemToTempFile("tls-client-public-key", "CERTIFICATE", der); err != nil {
+		return ClientTlsCert{}, err
+	}
+	if clientTlsCert.PrivateKeyPath, err = writePemToTempFile("tls-client-private-key", keyPem.Type, keyPem.Bytes); err != nil {
+		cleanupClientTlsCertFiles(clientTlsCert)
+		return ClientTlsCert{}, err
+	}
+	return clientTlsCert, nil
+}
 
-	terraformOptions := &terraform.Options{
-		TerraformDir: examplesDir,
-		Vars: map[string]interface{}{
-			VAR_CA_PUBLIC_KEY_FILE_PATH: caPublicKeyFilePath.Name(),
-			VAR_PUBLIC_KEY_FILE_PATH:    publicKeyFilePath.Name(),
-			VAR_PRIVATE_KEY_FILE_PATH:   privateKeyFilePath.Name(),
-			VAR_OWNER:                   currentUser.Username,
-			VAR_ORGANIZATION_NAME:       "Gruntwork",
-			VAR_CA_COMMON_NAME:          "Vault Module Test CA",
-			VAR_COMMON_NAME:             "Vault Module Test",
-			VAR_DNS_NAMES:               []string{"vault.service.consul"},
-			VAR_IP_ADDRESSES:            []string{"127.0.0.1"},
-			VAR_VALIDITY_PERIOD_HOURS:   1000,
+// Generate a key and a certificate for it with the given options, signed by the given CA. Returns the certificate in
+// DER and the key in PEM.
+func issueTlsCertE(options *TlsCertOptions, caCert *x509.Certificate, caKey crypto.Signer) ([]byte, *pem.Block, error) {
+	keyUsage, extKeyUsage, err := parseTlsAllowedUses(options.AllowedUses)
+	if err != nil {
+		return nil, nil, err
+	}
+	ipAddresses, err := parseIpAddresses(options.IpAddresses)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := generateTlsPrivateKey(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTlsCertTemplate(options, options.CommonName, keyUsage, extKeyUsage)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.DNSNames = options.DnsNames
+	template.IPAddresses = ipAddresses
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create certificate: %v", err)
+	}
+
+	keyPem, err := encodeTlsPrivateKeyPem(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return der, keyPem, nil
+}
+
+// Returns a certificate template with the subject, validity and key usages from the given options, and a random
+// serial number
+func newTlsCertTemplate(options *TlsCertOptions, commonName string, keyUsage x509.KeyUsage, extKeyUsage []x509.ExtKeyUsage) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate serial number: %v", err)
+	}
+
+	notBefore := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{options.OrganizationName},
 		},
+		NotBefore:   notBefore,
+		NotAfter:    notBefore.Add(time.Duration(options.ValidityPeriodHours) * time.Hour),
+		KeyUsage:    keyUsage,
+		ExtKeyUsage: extKeyUsage,
+	}, nil
+}
+
+// Generate a private key with the algorithm, curve and size in the given options
+func generateTlsPrivateKey(options *TlsCertOptions) (crypto.Signer, error) {
+	switch options.PrivateKeyAlgorithm {
+	case "RSA":
+		key, err := rsa.GenerateKey(rand.Reader, options.PrivateKeyRsaBits)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate %d bit RSA key: %v", options.PrivateKeyRsaBits, err)
+		}
+		return key, nil
+	case "ECDSA":
+		curve, ok := ecdsaCurves[options.PrivateKeyEcdsaCurve]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported ECDSA curve %q. Must be one of P224, P256, P384 or P521.", options.PrivateKeyEcdsaCurve)
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate ECDSA key with curve %s: %v", options.PrivateKeyEcdsaCurve, err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("Unsupported private key algorithm %q. Must be one of RSA or ECDSA.", options.PrivateKeyAlgorithm)
 	}
+}
 
-	defer terraform.Destroy(t, terraformOptions)
+// Read the PEM encoded private key in the file at the given path, in the format encodeTlsPrivateKeyPem writes it in
+func loadTlsPrivateKeyE(path string) (crypto.Signer, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("Expected a PEM encoded private key in %s", path)
+	}
 
-	terraform.InitAndApply(t, terraformOptions)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported private key type %s in %s", block.Type, path)
+	}
+}
 
-	assertFileNotEmpty(t, caPublicKeyFilePath.Name())
-	assertFileNotEmpty(t, publicKeyFilePath.Name())
-	assertFileNotEmpty(t, privateKeyFilePath.Name())
+// Encode the given private key the way the tls provider of Terraform does: PKCS #1 for RSA and SEC 1 for ECDSA
+func encodeTlsPrivateKeyPem(key crypto.Signer) (*pem.Block, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encode ECDSA private key: %v", err)
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported private key type %T", key)
+	}
+}
+
+// Returns the key usages for the given allowed uses of the tls provider of Terraform
+func parseTlsAllowedUses(allowedUses []string) (x509.KeyUsage, []x509.ExtKeyUsage, error) {
+	var keyUsage x509.KeyUsage
+	extKeyUsage := []x509.ExtKeyUsage{}
 
-	return TlsCert{
-		CAPublicKeyPath: caPublicKeyFilePath.Name(),
-		PublicKeyPath:   publicKeyFilePath.Name(),
-		PrivateKeyPath:  privateKeyFilePath.Name(),
+	for _, use := range allowedUses {
+		if usage, ok := tlsKeyUsages[use]; ok {
+			keyUsage |= usage
+		} else if usage, ok := tlsExtKeyUsages[use]; ok {
+			extKeyUsage = append(extKeyUsage, usage)
+		} else {
+			return 0, nil, fmt.Errorf("Unknown allowed use %q", use)
+		}
 	}
+	return keyUsage, extKeyUsage, nil
 }
 
-// Delete the temporary self-signed cert files we created
-func cleanupTLSCertFiles(tlsCert TlsCert) {
-	os.Remove(tlsCert.CAPublicKeyPath)
-	os.Remove(tlsCert.PrivateKeyPath)
-	os.Remove(tlsCert.PublicKeyPath)
+func parseIpAddresses(ipAddresses []string) ([]net.IP, error) {
+	ips := []net.IP{}
+	for _, ipAddress := range ipAddresses {
+		ip := net.ParseIP(ipAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address %q", ipAddress)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
 }
 
-// This is an attempt to catch a strange issue where the private-tls-cert module seems to occasionally create a private
-// key file that is completely empty. This doesn't fix the issue, but it at least helps us confirm that this is the
-// issue that is causing intermittent test failures.
-func assertFileNotEmpty(t *testing.T, path string) {
-	bytes, err := ioutil.ReadFile(path)
+// Returns the SHA-1 hash of the given public key, which is how most CAs identify their key. Go only fills in the
+// authority key id of the certs a CA signs if the CA has a subject key id.
+func getSubjectKeyId(publicKey crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode public key: %v", err)
+	}
+	hash := sha1.Sum(der)
+	return hash[:], nil
+}
+
+// Write the given DER bytes PEM encoded to a new temp file, which only the current user can read, and return its path
+func writePemToTempFile(prefix string, pemType string, der []byte) (string, error) {
+	file, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create temp file: %v", err)
+	}
+	defer file.Close()
+
+	if err := pem.Encode(file, &pem.Block{Type: pemType, Bytes: der}); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("Failed to write %s: %v", file.Name(), err)
+	}
+	return file.Name(), nil
+}
+
+// Read the PEM encoded certificate in the file at the given path
+func loadCertificate(t *testing.T, path string) *x509.Certificate {
+	cert, err := loadCertificateE(path)
 	if err != nil {
 		t.Fatal(err)
 	}
+	return cert
+}
 
-	fileContents := string(bytes)
-	if strings.TrimSpace(fileContents) == "" {
-		t.Fatalf("Expected file at %s to not be empty", path)
+// Read the PEM encoded certificate in the file at the given path
+func loadCertificateE(path string) (*x509.Certificate, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("Expected a PEM encoded certificate in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse certificate in %s: %v", path, err)
 	}
+	return cert, nil
+}
+
+// Delete the temporary self-signed cert files we created
+func cleanupTLSCertFiles(tlsCert TlsCert) {
+	os.Remove(tlsCert.CAPublicKeyPath)
+	os.Remove(tlsCert.CAPrivateKeyPath)
+	os.Remove(tlsCert.PrivateKeyPath)
+	os.Remove(tlsCert.PublicKeyPath)
+}
+
+// Delete the temporary client cert files we created
+func cleanupClientTlsCertFiles(clientTlsCert ClientTlsCert) {
+	os.Remove(clientTlsCert.PrivateKeyPath)
+	os.Remove(clientTlsCert.PublicKeyPath)
 }
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGenerateSelfSignedTlsCert(t *testing.T) {
+	t.Parallel()
+
+	tlsCert := generateSelfSignedTlsCert(t)
+	defer cleanupTLSCertFiles(tlsCert)
+
+	if _, err := tls.LoadX509KeyPair(tlsCert.PublicKeyPath, tlsCert.PrivateKeyPath); err != nil {
+		t.Fatalf("Expected the certificate to match its private key: %v", err)
+	}
+
+	ca := loadCertificate(t, tlsCert.CAPublicKeyPath)
+	if !ca.IsCA || ca.Subject.CommonName != "Vault Module Test CA" || ca.KeyUsage&x509.KeyUsageCertSign == 0 {
+		t.Fatalf("Unexpected CA certificate: %+v", ca.Subject)
+	}
+
+	cert := loadCertificate(t, tlsCert.PublicKeyPath)
+	if cert.IsCA || cert.Subject.CommonName != "Vault Module Test" || cert.Subject.Organization[0] != "Gruntwork" {
+		t.Fatalf("Unexpected certificate: %+v", cert.Subject)
+	}
+	if expiry := time.Until(cert.NotAfter); expiry < 999*time.Hour || expiry > 1000*time.Hour {
+		t.Fatalf("Expected the certificate to be valid for 1000 hours, but it expires in %s", expiry)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, name := range []string{"vault.service.consul", "127.0.0.1"} {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("Expected the certificate to be valid for %s: %v", name, err)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "vault.example.com", Roots: roots}); err == nil {
+		t.Error("Expected the certificate not to be valid for vault.example.com")
+	}
+}
+
+func TestGenerateTlsCertWithEcdsaKey(t *testing.T) {
+	t.Parallel()
+
+	options := getDefaultTlsCertOptions()
+	options.PrivateKeyAlgorithm = "ECDSA"
+	options.PrivateKeyEcdsaCurve = "P384"
+	options.IpAddresses = []string{"127.0.0.1", "10.0.0.2"}
+	options.AllowedUses = append(options.AllowedUses, "server_auth")
+
+	tlsCert := generateTlsCert(t, options)
+	defer cleanupTLSCertFiles(tlsCert)
+
+	keyPair, err := tls.LoadX509KeyPair(tlsCert.PublicKeyPath, tlsCert.PrivateKeyPath)
+	if err != nil {
+		t.Fatalf("Expected the certificate to match its private key: %v", err)
+	}
+	key, ok := keyPair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P384() {
+		t.Fatalf("Expected a P384 ECDSA key, but got %T", keyPair.PrivateKey)
+	}
+
+	cert := loadCertificate(t, tlsCert.PublicKeyPath)
+	if len(cert.IPAddresses) != 2 || !cert.IPAddresses[1].Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("Unexpected IP addresses: %v", cert.IPAddresses)
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Fatalf("Expected server_auth to be the only extended key usage, but got: %v", cert.ExtKeyUsage)
+	}
+}
+
+func TestGenerateTlsCertRejectsInvalidOptions(t *testing.T) {
+	t.Parallel()
+
+	invalidOptions := []func(options *TlsCertOptions){
+		func(options *TlsCertOptions) { options.PrivateKeyAlgorithm = "DSA" },
+		func(options *TlsCertOptions) {
+			options.PrivateKeyAlgorithm = "ECDSA"
+			options.PrivateKeyEcdsaCurve = "P192"
+		},
+		func(options *TlsCertOptions) { options.IpAddresses = []string{"vault.service.consul"} },
+		func(options *TlsCertOptions) { options.AllowedUses = []string{"world_domination"} },
+	}
+	for i, update := range invalidOptions {
+		options := getDefaultTlsCertOptions()
+		update(options)
+		if tlsCert, err := generateTlsCertE(options); err == nil {
+			cleanupTLSCertFiles(tlsCert)
+			t.Errorf("Expected invalid options %d to fail: %+v", i+1, options)
+		}
+	}
+}
+
+func TestGenerateClientTlsCert(t *testing.T) {
+	t.Parallel()
+
+	options := getDefaultTlsCertOptions()
+	options.PrivateKeyAlgorithm = "ECDSA"
+	caTlsCert := generateTlsCert(t, options)
+	defer cleanupTLSCertFiles(caTlsCert)
+
+	clientTlsCert := generateClientTlsCert(t, caTlsCert, "vault-test-client")
+	defer cleanupClientTlsCertFiles(clientTlsCert)
+
+	if _, err := tls.LoadX509KeyPair(clientTlsCert.PublicKeyPath, clientTlsCert.PrivateKeyPath); err != nil {
+		t.Fatalf("Expected the client certificate to match its private key: %v", err)
+	}
+
+	cert := loadCertificate(t, clientTlsCert.PublicKeyPath)
+	if cert.Subject.CommonName != "vault-test-client" || len(cert.DNSNames) != 0 || len(cert.IPAddresses) != 0 {
+		t.Fatalf("Unexpected client certificate: %+v %v %v", cert.Subject, cert.DNSNames, cert.IPAddresses)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(loadCertificate(t, caTlsCert.CAPublicKeyPath))
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatalf("Expected the client certificate to be valid for client auth with the CA: %v", err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}); err == nil {
+		t.Fatal("Expected the client certificate not to be valid for server auth")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/gruntwork-io/terratest/modules/http-helper"
+	"github.com/gruntwork-io/terratest/modules/logger"
 	"github.com/gruntwork-io/terratest/modules/random"
 	"github.com/gruntwork-io/terratest/modules/terraform"
 	"github.com/gruntwork-io/terratest/modules/test-structure"
@@ -29,10 +30,18 @@ func runVaultIamAuthTest(t *testing.T, packerBuildSaveName string) {
 		terraform.Destroy(t, terraformOptions)
 	})
 
+	defer test_structure.RunTestStage(t, "revoke_ssh_access", func() {
+		// Don't add a failure to the one of the deploy stage if it failed before there was SSH access to revoke
+		if !isSshAccessSaved(t, exampleDir) {
+			logger.Logf(t, "No SSH access was saved, so there is none to revoke")
+			return
+		}
+		access := loadSshAccess(t, exampleDir)
+		revokeSshAccess(t, access)
+	})
+
 	defer test_structure.RunTestStage(t, "log", func() {
-		//ToDo: Modify log retrieval to go through a bastion host
-		//      Requires adding feature to terratest
-		//writeVaultLogs(t, "vaultAuthIam", exampleDir)
+		writeVaultLogs(t, "vaultAuthIam", exampleDir, getDefaultVaultLogManifest())
 	})
 
 	test_structure.RunTestStage(t, "deploy", func() {
@@ -61,6 +70,8 @@ func runVaultIamAuthTest(t *testing.T, packerBuildSaveName string) {
 
 		test_structure.SaveTerraformOptions(t, exampleDir, terraformOptions)
 		terraform.InitAndApply(t, terraformOptions)
+
+		grantSshAccessThroughWebClient(t, exampleDir, terraformOptions)
 	})
 
 	test_structure.RunTestStage(t, "validate", func() {
@@ -77,10 +88,18 @@ func runVaultGceAuthTest(t *testing.T, packerBuildSaveName string) {
 		terraform.Destroy(t, terraformOptions)
 	})
 
+	defer test_structure.RunTestStage(t, "revoke_ssh_access", func() {
+		// Don't add a failure to the one of the deploy stage if it failed before there was SSH access to revoke
+		if !isSshAccessSaved(t, exampleDir) {
+			logger.Logf(t, "No SSH access was saved, so there is none to revoke")
+			return
+		}
+		access := loadSshAccess(t, exampleDir)
+		revokeSshAccess(t, access)
+	})
+
 	defer test_structure.RunTestStage(t, "log", func() {
-		//ToDo: Modify log retrieval to go through a bastion host
-		//      Requires adding feature to terratest
-		//writeVaultLogs(t, "vaultAuthGce", exampleDir)
+		writeVaultLogs(t, "vaultAuthGce", exampleDir, getDefaultVaultLogManifest())
 	})
 
 	test_structure.RunTestStage(t, "deploy", func() {
@@ -109,6 +128,8 @@ func runVaultGceAuthTest(t *testing.T, packerBuildSaveName string) {
 
 		test_structure.SaveTerraformOptions(t, exampleDir, terraformOptions)
 		terraform.InitAndApply(t, terraformOptions)
+
+		grantSshAccessThroughWebClient(t, exampleDir, terraformOptions)
 	})
 
 	test_structure.RunTestStage(t, "validate", func() {
@@ -118,6 +139,19 @@ func runVaultGceAuthTest(t *testing.T, packerBuildSaveName string) {
 	})
 }
 
+// The Vault nodes of the authentication examples are private, so grant SSH access to them and to the web client, which
+// is used as the bastion host to reach them through when collecting logs
+func grantSshAccessThroughWebClient(t *testing.T, exampleDir string, terraformOptions *terraform.Options) {
+	projectId := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_PROJECT_ID)
+	region := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_REGION_NAME)
+	instanceGroupName := terraform.OutputRequired(t, terraformOptions, TFOUT_INSTANCE_GROUP_NAME)
+	clusterSize := getClusterSize(t, terraformOptions)
+	webClientName := terraform.OutputRequired(t, terraformOptions, TFVAR_NAME_CLIENT_NAME)
+
+	access := grantSshAccess(t, projectId, region, instanceGroupName, clusterSize, webClientName, nil)
+	saveSshAccess(t, exampleDir, access)
+}
+
 func testRequestSecret(t *testing.T, terraformOptions *terraform.Options, expectedResponse string) {
 	webClientPublicIp := terraform.OutputRequired(t, terraformOptions, TFOUT_WEB_CLIENT_PUBLIC_IP)
 	url := fmt.Sprintf("http://%s:%s", webClientPublicIp, "8080")
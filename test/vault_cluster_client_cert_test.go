@@ -0,0 +1,95 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	"github.com/gruntwork-io/terratest/modules/test-structure"
+)
+
+const TFVAR_NAME_VAULT_TLS_REQUIRE_CLIENT_CERT = "vault_tls_require_client_cert"
+
+// Deploy the private cluster example with Vault listeners that require a client cert signed by the CA baked into the
+// image, and check that every node rejects clients without one. The vault CLI on the nodes doesn't present a client
+// cert, so this test doesn't initialize the cluster.
+func runVaultClientCertClusterTest(t *testing.T, packerBuildSaveName string) {
+	exampleDir := test_structure.CopyTerraformFolderToTemp(t, "../", "examples/vault-cluster-private")
+
+	defer test_structure.RunTestStage(t, "teardown", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, exampleDir)
+		terraform.Destroy(t, terraformOptions)
+	})
+
+	defer test_structure.RunTestStage(t, "revoke_ssh_access", func() {
+		// Don't add a failure to the one of the deploy stage if it failed before there was SSH access to revoke
+		if !isSshAccessSaved(t, exampleDir) {
+			logger.Logf(t, "No SSH access was saved, so there is none to revoke")
+			return
+		}
+		access := loadSshAccess(t, exampleDir)
+		revokeSshAccess(t, access)
+	})
+
+	defer test_structure.RunTestStage(t, "log", func() {
+		writeVaultLogs(t, "vaultClientCertCluster", exampleDir, getDefaultVaultLogManifest())
+	})
+
+	test_structure.RunTestStage(t, "deploy", func() {
+		projectId := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_PROJECT_ID)
+		region := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_REGION_NAME)
+		imageID := test_structure.LoadString(t, WORK_DIR, packerBuildSaveName)
+
+		// GCP only supports lowercase names for some resources
+		uniqueID := strings.ToLower(random.UniqueId())
+
+		consulClusterName := fmt.Sprintf("consul-test-%s", uniqueID)
+		vaultClusterName := fmt.Sprintf("vault-test-%s", uniqueID)
+
+		terraformOptions := &terraform.Options{
+			TerraformDir: exampleDir,
+			Vars: map[string]interface{}{
+				TFVAR_NAME_GCP_PROJECT_ID:                     projectId,
+				TFVAR_NAME_GCP_REGION:                         region,
+				TFVAR_NAME_CONSUL_SERVER_CLUSTER_NAME:         consulClusterName,
+				TFVAR_NAME_CONSUL_SOURCE_IMAGE:                imageID,
+				TFVAR_NAME_CONSUL_SERVER_CLUSTER_MACHINE_TYPE: "g1-small",
+				TFVAR_NAME_VAULT_CLUSTER_NAME:                 vaultClusterName,
+				TFVAR_NAME_VAULT_SOURCE_IMAGE:                 imageID,
+				TFVAR_NAME_VAULT_CLUSTER_MACHINE_TYPE:         "g1-small",
+				TFVAR_NAME_BASTION_SERVER_NAME:                fmt.Sprintf("bastion-test-%s", uniqueID),
+				TFVAR_NAME_SUBNET_CIDR:                        getRandomCidr(),
+				TFVAR_NAME_VAULT_TLS_REQUIRE_CLIENT_CERT:      true,
+			},
+		}
+
+		test_structure.SaveTerraformOptions(t, exampleDir, terraformOptions)
+
+		terraform.InitAndApply(t, terraformOptions)
+	})
+
+	test_structure.RunTestStage(t, "validate", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, exampleDir)
+		projectId := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_PROJECT_ID)
+		region := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_REGION_NAME)
+		instanceGroupName := terraform.OutputRequired(t, terraformOptions, TFOUT_INSTANCE_GROUP_NAME)
+		clusterSize := getClusterSize(t, terraformOptions)
+
+		bastionName := terraform.OutputRequired(t, terraformOptions, TFVAR_NAME_BASTION_SERVER_NAME)
+		access := grantSshAccess(t, projectId, region, instanceGroupName, clusterSize, bastionName, nil)
+		saveSshAccess(t, exampleDir, access)
+		bastionHost := access.BastionHost(t)
+
+		cluster := findVaultClusterNodes(t, projectId, region, instanceGroupName, clusterSize, access, bastionHost)
+		verifyCanSsh(t, cluster, bastionHost)
+
+		// Issued by the CA of the cert baked into the image, which the nodes verify client certs with
+		clientTlsCert := generateClientTlsCert(t, loadTLSCert(t, WORK_DIR), "vault-test-client")
+		defer cleanupClientTlsCertFiles(clientTlsCert)
+
+		assertVaultNodesRequireClientCert(t, cluster, bastionHost, clientTlsCert)
+	})
+}
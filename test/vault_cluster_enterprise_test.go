@@ -4,12 +4,9 @@ import (
 	"fmt"
 	"strings"
 	"testing"
-	"time"
 
-	"github.com/gruntwork-io/terratest/modules/gcp"
 	"github.com/gruntwork-io/terratest/modules/logger"
 	"github.com/gruntwork-io/terratest/modules/random"
-	"github.com/gruntwork-io/terratest/modules/retry"
 	"github.com/gruntwork-io/terratest/modules/ssh"
 	"github.com/gruntwork-io/terratest/modules/terraform"
 	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
@@ -35,7 +32,8 @@ const (
 // 4. TODO - SSH to a Vault node and check if Vault enterprise is installed properly
 // 5. SSH into a Vault node and initialize the Vault cluster
 // 6. SSH to each other Vault node, restart vault and test that it is unsealed
-// 7.  SSH to a Vault node and make sure you can communicate with the nodes via Consul-managed DNS
+// 7. Generate a root token with the recovery keys to prove the cluster can still be recovered
+// 8. SSH to a Vault node and make sure you can communicate with the nodes via Consul-managed DNS
 func runVaultEnterpriseClusterTest(t *testing.T, packerBuildSaveName string) {
 	exampleDir := test_structure.CopyTerraformFolderToTemp(t, "../", "examples/vault-cluster-enterprise")
 
@@ -44,10 +42,31 @@ func runVaultEnterpriseClusterTest(t *testing.T, packerBuildSaveName string) {
 		terraform.Destroy(t, terraformOptions)
 	})
 
+	defer test_structure.RunTestStage(t, "revoke_ssh_access", func() {
+		// Don't add a failure to the one of the deploy stage if it failed before there was SSH access to revoke
+		if !isSshAccessSaved(t, exampleDir) {
+			logger.Logf(t, "No SSH access was saved, so there is none to revoke")
+			return
+		}
+		access := loadSshAccess(t, exampleDir)
+		revokeSshAccess(t, access)
+	})
+
 	defer test_structure.RunTestStage(t, "log", func() {
-		//ToDo: Modify log retrieval to go through bastion host
-		//      Requires adding feature to terratest
-		//writeVaultLogs(t, "vaultEnterpriseCluster", exampleDir)
+		// Record which Vault Enterprise build the nodes run, as it's downloaded from a URL we don't log
+		manifest := getDefaultVaultLogManifest().With(VaultLogEntry{Name: "vault-version.txt", Command: "vault --version"})
+		writeVaultLogs(t, "vaultEnterpriseCluster", exampleDir, manifest)
+	})
+
+	defer test_structure.RunTestStage(t, "revoke_root_token", func() {
+		// Don't add a failure to the one of the deploy stage if it failed before there was a root token
+		if !isVaultClusterSaved(t, exampleDir) {
+			logger.Logf(t, "No Vault cluster was saved, so there is no root token to revoke")
+			return
+		}
+		cluster := loadVaultCluster(t, exampleDir)
+		bastionHost := loadBastionHost(t, exampleDir)
+		revokeRootToken(t, cluster, bastionHost)
 	})
 
 	test_structure.RunTestStage(t, "deploy", func() {
@@ -90,60 +109,44 @@ func runVaultEnterpriseClusterTest(t *testing.T, packerBuildSaveName string) {
 		projectId := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_PROJECT_ID)
 		region := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_REGION_NAME)
 		instanceGroupName := terraform.OutputRequired(t, terraformOptions, TFOUT_INSTANCE_GROUP_NAME)
-
-		sshUserName := "terratest"
-		keyPair := ssh.GenerateRSAKeyPair(t, 2048)
-		saveKeyPair(t, exampleDir, keyPair)
-		addKeyPairToInstancesInGroup(t, projectId, region, instanceGroupName, keyPair, sshUserName, 3)
+		clusterSize := getClusterSize(t, terraformOptions)
 
 		bastionName := terraform.OutputRequired(t, terraformOptions, TFVAR_NAME_BASTION_SERVER_NAME)
-		bastionInstance := gcp.FetchInstance(t, projectId, bastionName)
-		bastionInstance.AddSshKey(t, sshUserName, keyPair.PublicKey)
-		bastionHost := ssh.Host{
-			Hostname:    bastionInstance.GetPublicIp(t),
-			SshUserName: sshUserName,
-			SshKeyPair:  keyPair,
-		}
-
-		cluster := testVaultInitializeAutoUnseal(t, projectId, region, instanceGroupName, sshUserName, keyPair, &bastionHost)
-		testVaultUsesConsulForDns(t, cluster, &bastionHost)
+		access := grantSshAccess(t, projectId, region, instanceGroupName, clusterSize, bastionName, nil)
+		saveSshAccess(t, exampleDir, access)
+		bastionHost := access.BastionHost(t)
+		saveBastionHost(t, exampleDir, bastionHost)
+
+		cluster := testVaultInitializeAutoUnseal(t, projectId, region, instanceGroupName, clusterSize, access, bastionHost)
+		saveVaultCluster(t, exampleDir, cluster)
+		verifyRecoveryKeys(t, cluster, bastionHost)
+		testVaultUsesConsulForDns(t, cluster, bastionHost)
 	})
 }
 
-func testVaultInitializeAutoUnseal(t *testing.T, projectId string, region string, instanceGroupName string, sshUserName string, sshKeyPair *ssh.KeyPair, bastionHost *ssh.Host) *VaultCluster {
-	cluster := findVaultClusterNodes(t, projectId, region, instanceGroupName, sshUserName, sshKeyPair, bastionHost)
+func testVaultInitializeAutoUnseal(t *testing.T, projectId string, region string, instanceGroupName string, clusterSize int, access *SshAccess, bastionHost *ssh.Host) *VaultCluster {
+	cluster := findVaultClusterNodes(t, projectId, region, instanceGroupName, clusterSize, access, bastionHost)
 
 	verifyCanSsh(t, cluster, bastionHost)
-	testVaultIsEnterprise(t, cluster.Leader, bastionHost)
+	testVaultIsEnterprise(t, cluster.NodeExecutor(t, cluster.InitNode(), bastionHost))
 
-	initializeVault(t, cluster, bastionHost)
-	assertNodeStatus(t, cluster.Leader, bastionHost, Leader)
+	initResponse := initializeVault(t, cluster, bastionHost, nil)
+	if len(initResponse.RecoveryKeysB64) == 0 {
+		t.Fatalf("Expected vault init to return recovery keys for a cluster that uses auto-unseal")
+	}
+	logger.Logf(t, "Vault init returned %d recovery keys with a threshold of %d", len(initResponse.RecoveryKeysB64), initResponse.RecoveryKeysThreshold)
+	assertNodeStatus(t, cluster.NodeClient(t, cluster.InitNode(), bastionHost), Leader)
 
 	//Testing that other members of cluster will be unsealed after restarting
-	assertNodeStatus(t, cluster.Standby1, bastionHost, Sealed)
-	restartVault(t, cluster.Standby1, bastionHost)
-	assertNodeStatus(t, cluster.Standby1, bastionHost, Standby)
-
-	assertNodeStatus(t, cluster.Standby2, bastionHost, Sealed)
-	restartVault(t, cluster.Standby2, bastionHost)
-	assertNodeStatus(t, cluster.Standby2, bastionHost, Standby)
+	for _, node := range cluster.Nodes[1:] {
+		nodeClient := cluster.NodeClient(t, node, bastionHost)
+		assertNodeStatus(t, nodeClient, Sealed)
+		restartVault(t, cluster.NodeExecutor(t, node, bastionHost))
+		assertNodeStatus(t, nodeClient, Standby)
+	}
+
+	roles := discoverVaultClusterRoles(t, cluster, bastionHost)
+	logger.Logf(t, "Vault cluster roles after auto-unseal: active node is %s, standby nodes are %v", roles.Active.Hostname, getHostnames(roles.Standbys))
+	assertVaultClusterConsistent(t, cluster, bastionHost)
 	return cluster
 }
-
-func testVaultIsEnterprise(t *testing.T, targetHost ssh.Host, bastionHost *ssh.Host) {
-	retry.DoWithRetry(t, "Testing Vault Version", 3, 5*time.Second, func() (string, error) {
-		output, err := runCommand(t, bastionHost, &targetHost, "vault --version")
-		if !strings.Contains(output, "+ent") {
-			return "", fmt.Errorf("This vault package is not the expected enterprise version. Actual version: %s", output)
-		}
-		return "", err
-	})
-}
-
-func restartVault(t *testing.T, targetHost ssh.Host, bastionHost *ssh.Host) {
-	retry.DoWithRetry(t, "Restarting vault", 3, 5*time.Second, func() (string, error) {
-		output, err := runCommand(t, bastionHost, &targetHost, "sudo supervisorctl restart vault")
-		logger.Logf(t, "Vault Restarting output: %s", output)
-		return output, err
-	})
-}
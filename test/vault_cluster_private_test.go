@@ -5,9 +5,8 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/gruntwork-io/terratest/modules/gcp"
+	"github.com/gruntwork-io/terratest/modules/logger"
 	"github.com/gruntwork-io/terratest/modules/random"
-	"github.com/gruntwork-io/terratest/modules/ssh"
 	"github.com/gruntwork-io/terratest/modules/terraform"
 	"github.com/gruntwork-io/terratest/modules/test-structure"
 )
@@ -25,10 +24,29 @@ func runVaultPrivateClusterTest(t *testing.T, packerBuildSaveName string) {
 		terraform.Destroy(t, terraformOptions)
 	})
 
+	defer test_structure.RunTestStage(t, "revoke_ssh_access", func() {
+		// Don't add a failure to the one of the deploy stage if it failed before there was SSH access to revoke
+		if !isSshAccessSaved(t, exampleDir) {
+			logger.Logf(t, "No SSH access was saved, so there is none to revoke")
+			return
+		}
+		access := loadSshAccess(t, exampleDir)
+		revokeSshAccess(t, access)
+	})
+
 	defer test_structure.RunTestStage(t, "log", func() {
-		//ToDo: Modify log retrieval to go through bastion host
-		//      Requires adding feature to terratest
-		//writeVaultLogs(t, "vaultPrivateCluster", exampleDir)
+		writeVaultLogs(t, "vaultPrivateCluster", exampleDir, getDefaultVaultLogManifest())
+	})
+
+	defer test_structure.RunTestStage(t, "revoke_root_token", func() {
+		// Don't add a failure to the one of the deploy stage if it failed before there was a root token
+		if !isVaultClusterSaved(t, exampleDir) {
+			logger.Logf(t, "No Vault cluster was saved, so there is no root token to revoke")
+			return
+		}
+		cluster := loadVaultCluster(t, exampleDir)
+		bastionHost := loadBastionHost(t, exampleDir)
+		revokeRootToken(t, cluster, bastionHost)
 	})
 
 	test_structure.RunTestStage(t, "deploy", func() {
@@ -68,22 +86,42 @@ func runVaultPrivateClusterTest(t *testing.T, packerBuildSaveName string) {
 		projectId := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_PROJECT_ID)
 		region := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_REGION_NAME)
 		instanceGroupName := terraform.OutputRequired(t, terraformOptions, TFOUT_INSTANCE_GROUP_NAME)
-
-		sshUserName := "terratest"
-		keyPair := ssh.GenerateRSAKeyPair(t, 2048)
-		saveKeyPair(t, exampleDir, keyPair)
-		addKeyPairToInstancesInGroup(t, projectId, region, instanceGroupName, keyPair, sshUserName, 3)
+		clusterSize := getClusterSize(t, terraformOptions)
 
 		bastionName := terraform.OutputRequired(t, terraformOptions, TFVAR_NAME_BASTION_SERVER_NAME)
-		bastionInstance := gcp.FetchInstance(t, projectId, bastionName)
-		bastionInstance.AddSshKey(t, sshUserName, keyPair.PublicKey)
-		bastionHost := ssh.Host{
-			Hostname:    bastionInstance.GetPublicIp(t),
-			SshUserName: sshUserName,
-			SshKeyPair:  keyPair,
+		access := grantSshAccess(t, projectId, region, instanceGroupName, clusterSize, bastionName, nil)
+		saveSshAccess(t, exampleDir, access)
+		bastionHost := access.BastionHost(t)
+		saveBastionHost(t, exampleDir, bastionHost)
+
+		// Run the same key ceremony as a hardened production deployment: a non-default split with every unseal key and
+		// the root token encrypted to a different PGP key
+		initOptions := &VaultInitOptions{
+			KeyShares:       7,
+			KeyThreshold:    4,
+			PgpKeys:         generatePgpKeyPairs(t, "unseal-key", 7),
+			RootTokenPgpKey: generatePgpKeyPair(t, "root-token"),
 		}
 
-		cluster := initializeAndUnsealVaultCluster(t, projectId, region, instanceGroupName, sshUserName, keyPair, &bastionHost)
-		testVaultUsesConsulForDns(t, cluster, &bastionHost)
+		cluster := initializeAndUnsealVaultCluster(t, projectId, region, instanceGroupName, clusterSize, access, bastionHost, SshTransport, initOptions)
+		assertVaultNodesServeCert(t, cluster, bastionHost, loadTLSCert(t, WORK_DIR))
+		testVaultUsesConsulForDns(t, cluster, bastionHost)
+
+		// Replace the root token returned by init with a newly generated one, as a hardened deployment would
+		newRootToken := generateRootTokenForCluster(t, cluster, bastionHost)
+		revokeRootToken(t, cluster, bastionHost)
+		cluster.RootToken = newRootToken
+		assertTokenIsRoot(t, cluster.NodeExecutor(t, cluster.GetActiveNode(t, bastionHost), bastionHost), cluster.RootToken)
+
+		// Move to a new split of unseal keys and a new encryption key, then prove the new keys unseal every node
+		testVaultRekeyAndRotate(t, cluster, bastionHost, 5, 3)
+		saveVaultCluster(t, exampleDir, cluster)
+
+		// The nodes have no public address, so use the typed Vault API through an SSH tunnel via the bastion host
+		testVaultApiThroughTunnel(t, cluster, bastionHost)
+
+		// Last, as the clients of the other checks only trust the CA of the cert baked into the image
+		newTlsCert := testVaultTlsCertRotation(t, cluster, bastionHost, loadTLSCert(t, WORK_DIR))
+		defer cleanupTLSCertFiles(newTlsCert)
 	})
 }
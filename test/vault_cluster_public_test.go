@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/gruntwork-io/terratest/modules/logger"
 	"github.com/gruntwork-io/terratest/modules/random"
 	"github.com/gruntwork-io/terratest/modules/ssh"
 	"github.com/gruntwork-io/terratest/modules/terraform"
@@ -31,8 +32,28 @@ func runVaultPublicClusterTest(t *testing.T, packerBuildSaveName string) {
 		terraform.Destroy(t, terraformOptions)
 	})
 
+	defer test_structure.RunTestStage(t, "revoke_ssh_access", func() {
+		// Don't add a failure to the one of the deploy stage if it failed before there was SSH access to revoke
+		if !isSshAccessSaved(t, exampleDir) {
+			logger.Logf(t, "No SSH access was saved, so there is none to revoke")
+			return
+		}
+		access := loadSshAccess(t, exampleDir)
+		revokeSshAccess(t, access)
+	})
+
 	defer test_structure.RunTestStage(t, "log", func() {
-		writeVaultLogs(t, "vaultPublicCluster", exampleDir)
+		writeVaultLogs(t, "vaultPublicCluster", exampleDir, getDefaultVaultLogManifest())
+	})
+
+	defer test_structure.RunTestStage(t, "revoke_root_token", func() {
+		// Don't add a failure to the one of the deploy stage if it failed before there was a root token
+		if !isVaultClusterSaved(t, exampleDir) {
+			logger.Logf(t, "No Vault cluster was saved, so there is no root token to revoke")
+			return
+		}
+		cluster := loadVaultCluster(t, exampleDir)
+		revokeRootToken(t, cluster, nil)
 	})
 
 	test_structure.RunTestStage(t, "deploy", func() {
@@ -70,13 +91,25 @@ func runVaultPublicClusterTest(t *testing.T, packerBuildSaveName string) {
 		projectId := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_PROJECT_ID)
 		region := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_REGION_NAME)
 		instanceGroupName := terraform.OutputRequired(t, terraformOptions, TFOUT_INSTANCE_GROUP_NAME)
-
-		sshUserName := "terratest"
-		keyPair := ssh.GenerateRSAKeyPair(t, 2048)
-		saveKeyPair(t, exampleDir, keyPair)
-		addKeyPairToInstancesInGroup(t, projectId, region, instanceGroupName, keyPair, sshUserName, 3)
-
-		cluster := initializeAndUnsealVaultCluster(t, projectId, region, instanceGroupName, sshUserName, keyPair, nil)
-		testVault(t, cluster.Leader.Hostname)
+		clusterSize := getClusterSize(t, terraformOptions)
+
+		access := grantSshAccess(t, projectId, region, instanceGroupName, clusterSize, "", nil)
+		saveSshAccess(t, exampleDir, access)
+
+		// The nodes of the public cluster are reachable on the Vault port, so talk to them through the Vault API. The private
+		// cluster test covers the SSH transport, which checks the TLS trust on the nodes themselves.
+		cluster := initializeAndUnsealVaultCluster(t, projectId, region, instanceGroupName, clusterSize, access, nil, ApiTransport, nil)
+		activeNode := cluster.GetActiveNode(t, nil)
+		testVault(t, activeNode.Hostname)
+		assertVaultNodesServeCert(t, cluster, nil, loadTLSCert(t, WORK_DIR))
+
+		// The run-nginx module proxies load balancer health checks to /v1/sys/health?standbyok=true, which should route
+		// traffic to every unsealed node, while the default query should only route traffic to the active node
+		assertHealthQueryMatrix(t, cluster, nil, getDefaultVaultHealthQueries())
+		assertHealthQueryRoutesTo(t, cluster, nil, VaultHealthQuery{StandbyOk: true}, cluster.Nodes)
+		assertHealthQueryRoutesTo(t, cluster, nil, VaultHealthQuery{}, []ssh.Host{activeNode})
+
+		testRootTokenLifecycle(t, cluster, activeNode.Hostname)
+		saveVaultCluster(t, exampleDir, cluster)
 	})
 }
@@ -0,0 +1,261 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+)
+
+// The response of /v1/sys/health, together with the HTTP status code it was returned with. The api package of the
+// Vault version we use doesn't decode performance_standby, which is why we don't use api.HealthResponse.
+// From: https://www.vaultproject.io/api/system/health.html
+type VaultHealth struct {
+	StatusCode                 VaultStatus `json:"-"`
+	Initialized                bool        `json:"initialized"`
+	Sealed                     bool        `json:"sealed"`
+	Standby                    bool        `json:"standby"`
+	PerformanceStandby         bool        `json:"performance_standby"`
+	ReplicationPerformanceMode string      `json:"replication_performance_mode"`
+	ReplicationDrMode          string      `json:"replication_dr_mode"`
+	ServerTimeUtc              int64       `json:"server_time_utc"`
+	Version                    string      `json:"version"`
+	ClusterName                string      `json:"cluster_name"`
+	ClusterId                  string      `json:"cluster_id"`
+}
+
+// Use curl to read /v1/sys/health on the given Vault node and decode both the status code and the response body
+func getNodeHealth(t *testing.T, executor Executor) *VaultHealth {
+	health, err := getNodeHealthE(t, executor)
+	if err != nil {
+		t.Fatalf("Failed to read the health of Vault node %s: %v", executor.Hostname(), err)
+	}
+	return health
+}
+
+// Use curl to read /v1/sys/health on the given Vault node and decode both the status code and the response body
+func getNodeHealthE(t *testing.T, executor Executor) (*VaultHealth, error) {
+	// Print the status code on a line of its own after the response body, so both can be read from a single request
+	curlCommand := fmt.Sprintf("curl -s -w '\\n%%{http_code}' 'https://127.0.0.1:%d/v1/sys/health'", VAULT_PORT)
+	logger.Logf(t, "Using curl to check health of Vault server %s: %s", executor.Hostname(), curlCommand)
+
+	output, err := runCommand(executor, curlCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	health, err := parseVaultHealthOutput(output)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse /v1/sys/health response from host %s: %v", executor.Hostname(), err)
+	}
+	return health, nil
+}
+
+// Parse the output of curl for /v1/sys/health, which is the response body followed by the status code on its own line
+func parseVaultHealthOutput(output string) (*VaultHealth, error) {
+	body, statusCode, err := parseCurlOutputWithStatusCode(output)
+	if err != nil {
+		return nil, err
+	}
+
+	var health VaultHealth
+	if err := json.Unmarshal([]byte(body), &health); err != nil {
+		return nil, fmt.Errorf("Failed to parse response body: %v. Output: %s", err, output)
+	}
+	health.StatusCode = VaultStatus(statusCode)
+	return &health, nil
+}
+
+// Split the output of curl run with -w '\n%{http_code}' into the response body and the status code
+func parseCurlOutputWithStatusCode(output string) (string, int, error) {
+	output = strings.TrimSpace(output)
+	separator := strings.LastIndex(output, "\n")
+	if separator < 0 {
+		return "", 0, fmt.Errorf("Expected a response body and a status code, but got: %s", output)
+	}
+
+	statusCode, err := strconv.Atoi(strings.TrimSpace(output[separator+1:]))
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to parse status code: %v. Output: %s", err, output)
+	}
+	return output[:separator], statusCode, nil
+}
+
+// Check that the response body of /v1/sys/health agrees with the status code it was returned with, e.g. that a node
+// returning the standby status code also says it's a standby and isn't sealed
+func checkHealthMatchesStatus(health *VaultHealth) error {
+	var mismatch string
+
+	switch health.StatusCode {
+	case Leader:
+		if !health.Initialized || health.Sealed || health.Standby || health.PerformanceStandby {
+			mismatch = "an initialized, unsealed, active node"
+		}
+	case Standby:
+		if !health.Initialized || health.Sealed || !health.Standby || health.PerformanceStandby {
+			mismatch = "an initialized, unsealed standby"
+		}
+	case PerformanceStandby:
+		if !health.Initialized || health.Sealed || !health.Standby || !health.PerformanceStandby {
+			mismatch = "an initialized, unsealed performance standby"
+		}
+	case DrSecondary:
+		if !health.Initialized || health.ReplicationDrMode != "secondary" {
+			mismatch = "an initialized DR secondary"
+		}
+	case Uninitialized:
+		if health.Initialized {
+			mismatch = "an uninitialized node"
+		}
+	case Sealed:
+		if !health.Initialized || !health.Sealed {
+			mismatch = "an initialized, sealed node"
+		}
+	default:
+		return fmt.Errorf("Unexpected /v1/sys/health status code %d", int(health.StatusCode))
+	}
+
+	if mismatch != "" {
+		return fmt.Errorf("Status code %d means %s, but the response says initialized=%t, sealed=%t, standby=%t, performance_standby=%t, replication_dr_mode=%q", int(health.StatusCode), mismatch, health.Initialized, health.Sealed, health.Standby, health.PerformanceStandby, health.ReplicationDrMode)
+	}
+	return nil
+}
+
+// A combination of the query parameters of /v1/sys/health that load balancer health checks use to decide which nodes
+// get traffic. Status codes that are left at zero fall back to Vault's defaults.
+type VaultHealthQuery struct {
+	StandbyOk     bool
+	PerfStandbyOk bool
+	ActiveCode    int
+	StandbyCode   int
+	SealedCode    int
+	UninitCode    int
+}
+
+// Returns the query string for these parameters, e.g. "standbyok=true&sealedcode=200"
+func (q VaultHealthQuery) String() string {
+	params := []string{}
+	if q.StandbyOk {
+		params = append(params, "standbyok=true")
+	}
+	if q.PerfStandbyOk {
+		params = append(params, "perfstandbyok=true")
+	}
+
+	codes := []struct {
+		name string
+		code int
+	}{
+		{"activecode", q.ActiveCode},
+		{"standbycode", q.StandbyCode},
+		{"sealedcode", q.SealedCode},
+		{"uninitcode", q.UninitCode},
+	}
+	for _, param := range codes {
+		if param.code != 0 {
+			params = append(params, fmt.Sprintf("%s=%d", param.name, param.code))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// Returns the status code a node should return for these parameters, given the health it reports without any. This
+// follows the order in which Vault itself picks the status code.
+func (q VaultHealthQuery) ExpectedStatusCode(health *VaultHealth) int {
+	switch {
+	case !health.Initialized:
+		return codeOrDefault(q.UninitCode, int(Uninitialized))
+	case health.Sealed:
+		return codeOrDefault(q.SealedCode, int(Sealed))
+	case health.ReplicationDrMode == "secondary":
+		return int(DrSecondary)
+	case health.PerformanceStandby:
+		// A performance standby also reports standby, but perfstandbyok alone decides its status code
+		if q.PerfStandbyOk {
+			return codeOrDefault(q.ActiveCode, int(Leader))
+		}
+		return int(PerformanceStandby)
+	case health.Standby && !q.StandbyOk:
+		return codeOrDefault(q.StandbyCode, int(Standby))
+	default:
+		return codeOrDefault(q.ActiveCode, int(Leader))
+	}
+}
+
+func codeOrDefault(code int, defaultCode int) int {
+	if code != 0 {
+		return code
+	}
+	return defaultCode
+}
+
+// Returns the combinations of /v1/sys/health query parameters that the load balancer health checks of this repo and
+// the ones we document rely on, including custom status codes
+func getDefaultVaultHealthQueries() []VaultHealthQuery {
+	return []VaultHealthQuery{
+		{},
+		{StandbyOk: true},
+		{PerfStandbyOk: true},
+		{StandbyOk: true, PerfStandbyOk: true},
+		{ActiveCode: 250, StandbyCode: 251, SealedCode: 252, UninitCode: 253},
+		{StandbyOk: true, StandbyCode: 251},
+		{SealedCode: int(Leader), UninitCode: int(Leader)},
+	}
+}
+
+// Probe /v1/sys/health on every node of the given cluster with each of the given query parameter combinations, and
+// check that each node returns the status code that matches its role
+func assertHealthQueryMatrix(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host, queries []VaultHealthQuery) {
+	for _, node := range cluster.Nodes {
+		executor := cluster.NodeExecutor(t, node, bastionHost)
+		health := getNodeHealth(t, executor)
+
+		for _, query := range queries {
+			expectedStatusCode := query.ExpectedStatusCode(health)
+			actualStatusCode, err := getNodeHealthStatusCodeE(t, executor, query)
+			if err != nil {
+				t.Fatalf("Failed to probe the health of Vault node %s with query %q: %v", node.Hostname, query.String(), err)
+			}
+			if actualStatusCode != expectedStatusCode {
+				t.Fatalf("Expected Vault node %s (initialized=%t, sealed=%t, standby=%t, performance_standby=%t) to return status code %d for query %q, but got %d", node.Hostname, health.Initialized, health.Sealed, health.Standby, health.PerformanceStandby, expectedStatusCode, query.String(), actualStatusCode)
+			}
+		}
+
+		logger.Logf(t, "Vault node %s returned the expected status code for all %d health queries", node.Hostname, len(queries))
+	}
+}
+
+// Check that a load balancer health check using the given query parameters would route traffic to exactly the given
+// nodes of the cluster. Load balancers only consider nodes that return 200 healthy.
+func assertHealthQueryRoutesTo(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host, query VaultHealthQuery, expectedHosts []ssh.Host) {
+	expectedHostnames := map[string]bool{}
+	for _, host := range expectedHosts {
+		expectedHostnames[host.Hostname] = true
+	}
+
+	for _, node := range cluster.Nodes {
+		statusCode, err := getNodeHealthStatusCodeE(t, cluster.NodeExecutor(t, node, bastionHost), query)
+		if err != nil {
+			t.Fatalf("Failed to probe the health of Vault node %s with query %q: %v", node.Hostname, query.String(), err)
+		}
+
+		healthy := statusCode == int(Leader)
+		if healthy != expectedHostnames[node.Hostname] {
+			t.Fatalf("Expected a health check with query %q to route traffic only to %v, but Vault node %s returned status code %d", query.String(), getHostnames(expectedHosts), node.Hostname, statusCode)
+		}
+	}
+}
+
+// Use curl to get the HTTP status code of /v1/sys/health with the given query parameters on the given Vault node
+func getNodeHealthStatusCodeE(t *testing.T, executor Executor, query VaultHealthQuery) (int, error) {
+	curlCommand := fmt.Sprintf("curl -s -o /dev/null -w '%%{http_code}' 'https://127.0.0.1:%d/v1/sys/health?%s'", VAULT_PORT, query.String())
+	output, err := runCommand(executor, curlCommand)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(output))
+}
@@ -0,0 +1,102 @@
+package test
+
+import (
+	"testing"
+)
+
+func TestParseVaultHealthOutput(t *testing.T) {
+	t.Parallel()
+
+	health, err := parseVaultHealthOutput(`{"initialized":true,"sealed":false,"standby":true,"performance_standby":false,"version":"0.11.5","cluster_name":"vault-cluster-1","cluster_id":"abc"}` + "\n429\n")
+	if err != nil {
+		t.Fatalf("Failed to parse health output: %v", err)
+	}
+	if health.StatusCode != Standby || !health.Standby || health.ClusterId != "abc" {
+		t.Fatalf("Unexpected health: %+v", health)
+	}
+	if err := checkHealthMatchesStatus(health); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseVaultHealthOutputFailsWithoutStatusCode(t *testing.T) {
+	t.Parallel()
+
+	if _, err := parseVaultHealthOutput(`{"initialized":true}`); err == nil {
+		t.Fatal("Expected output without a status code to fail")
+	}
+}
+
+func TestCheckHealthMatchesStatusFailsOnMismatch(t *testing.T) {
+	t.Parallel()
+
+	health := &VaultHealth{StatusCode: Leader, Initialized: true, Standby: true}
+	if err := checkHealthMatchesStatus(health); err == nil {
+		t.Fatal("Expected a standby returning the active status code to fail")
+	}
+}
+
+func TestVaultHealthQueryExpectedStatusCode(t *testing.T) {
+	t.Parallel()
+
+	active := &VaultHealth{Initialized: true}
+	standby := &VaultHealth{Initialized: true, Standby: true}
+	sealed := &VaultHealth{Initialized: true, Sealed: true}
+	perfStandby := &VaultHealth{Initialized: true, Standby: true, PerformanceStandby: true}
+
+	testCases := []struct {
+		query    VaultHealthQuery
+		health   *VaultHealth
+		expected int
+	}{
+		{VaultHealthQuery{}, active, 200},
+		{VaultHealthQuery{}, standby, 429},
+		{VaultHealthQuery{}, sealed, 503},
+		{VaultHealthQuery{StandbyOk: true}, standby, 200},
+		{VaultHealthQuery{StandbyOk: true, ActiveCode: 250}, standby, 250},
+		{VaultHealthQuery{StandbyCode: 251}, standby, 251},
+		{VaultHealthQuery{SealedCode: 200}, sealed, 200},
+		{VaultHealthQuery{}, perfStandby, 473},
+		{VaultHealthQuery{StandbyOk: true}, perfStandby, 473},
+		{VaultHealthQuery{PerfStandbyOk: true}, perfStandby, 200},
+		{VaultHealthQuery{PerfStandbyOk: true, ActiveCode: 250}, perfStandby, 250},
+	}
+
+	for _, testCase := range testCases {
+		actual := testCase.query.ExpectedStatusCode(testCase.health)
+		if actual != testCase.expected {
+			t.Errorf("Expected status code %d for query %q and health %+v, but got %d", testCase.expected, testCase.query.String(), testCase.health, actual)
+		}
+	}
+}
+
+func TestGetNodeHealthOverSsh(t *testing.T) {
+	t.Parallel()
+
+	node, backend, server := newTestSshVaultNodeClient(t, []ScriptedCommand{
+		{Match: `/v1/sys/health'$`, Output: `{"initialized":true,"sealed":true,"standby":true}` + "\n503"},
+	})
+	defer server.Stop()
+
+	assertNodeStatus(t, node, Sealed)
+
+	if err := backend.CheckScriptDone(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetNodeHealthStatusCodeIgnoresStderr(t *testing.T) {
+	t.Parallel()
+
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `/v1/sys/health\?standbyok=true'$`, Output: "200", Stderr: "bash: warning: setlocale: LC_ALL: cannot change locale (en_US.UTF-8)\n"},
+	}}
+
+	statusCode, err := getNodeHealthStatusCodeE(t, executor, VaultHealthQuery{StandbyOk: true})
+	if err != nil {
+		t.Fatalf("Expected a warning on stderr not to break parsing the status code, but got: %v", err)
+	}
+	if statusCode != 200 {
+		t.Fatalf("Expected status code 200, but got %d", statusCode)
+	}
+}
@@ -1,112 +1,170 @@
 package test
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/gruntwork-io/terratest/modules/files"
 	"github.com/gruntwork-io/terratest/modules/gcp"
 	"github.com/gruntwork-io/terratest/modules/logger"
 	"github.com/gruntwork-io/terratest/modules/retry"
 	"github.com/gruntwork-io/terratest/modules/ssh"
 	"github.com/gruntwork-io/terratest/modules/terraform"
-	"github.com/gruntwork-io/terratest/modules/test-structure"
 	"github.com/hashicorp/vault/api"
 )
 
 const LOGS_STORAGE_PATH = "/tmp/logs/"
 const VAULT_PORT = 8200
 
+// The name Vault is reached at through Consul DNS, which the cert baked into the images is valid for
+const VAULT_TLS_SERVER_NAME = "vault.service.consul"
+const VAULT_INIT_PGP_KEYS_DIR = "/tmp/vault-init-pgp-keys"
+
 // Terraform Outputs
 const TFOUT_INSTANCE_GROUP_NAME = "instance_group_name"
+const TFOUT_VAULT_CLUSTER_SIZE = "vault_cluster_size"
 
 type VaultCluster struct {
-	Leader     ssh.Host
-	Standby1   ssh.Host
-	Standby2   ssh.Host
-	UnsealKeys []string
+	Nodes        []ssh.Host
+	Transport    VaultTransport
+	Executors    map[string]Executor `json:"-"` // Overrides how commands are run on the nodes, keyed by hostname
+	SshAccess    *SshAccess          `json:"-"` // Saved on its own, so the key pair isn't stored twice
+	UnsealKeys   []string
+	RecoveryKeys []string
+	RootToken    string
+	InitResponse *VaultInitResponse
 }
 
 func (c *VaultCluster) GetSshHosts() []ssh.Host {
-	return []ssh.Host{c.Leader, c.Standby1, c.Standby2}
+	return c.Nodes
+}
+
+// Add the key of the SSH access of the cluster, if it has one, to the nodes the instance group recreated since, and
+// wait until they accept it. Call it before each phase that SSHes to the nodes.
+func (c *VaultCluster) RefreshSshAccess(t *testing.T) {
+	if c.SshAccess != nil {
+		c.SshAccess.Refresh(t)
+	}
+}
+
+// The node we run `vault operator init` on and unseal first. Until the cluster has been unsealed there is no active
+// node to ask Vault about, so this is the only role we assign ourselves.
+func (c *VaultCluster) InitNode() ssh.Host {
+	return c.Nodes[0]
+}
+
+// Ask Vault which node is currently the active node. Roles change on failover, so this is re-resolved on every call.
+func (c *VaultCluster) GetActiveNode(t *testing.T, bastionHost *ssh.Host) ssh.Host {
+	return discoverVaultClusterRoles(t, c, bastionHost).Active
+}
+
+// Ask Vault which nodes are currently standby nodes. Roles change on failover, so this is re-resolved on every call.
+func (c *VaultCluster) GetStandbyNodes(t *testing.T, bastionHost *ssh.Host) []ssh.Host {
+	return discoverVaultClusterRoles(t, c, bastionHost).Standbys
+}
+
+// The roles of the nodes in a Vault cluster, as reported by the nodes themselves
+type VaultClusterRoles struct {
+	Active   ssh.Host
+	Standbys []ssh.Host
+}
+
+// The output of `vault operator init -format=json`
+type VaultInitResponse struct {
+	UnsealKeysB64         []string `json:"unseal_keys_b64"`
+	UnsealKeysHex         []string `json:"unseal_keys_hex"`
+	UnsealShares          int      `json:"unseal_shares"`
+	UnsealThreshold       int      `json:"unseal_threshold"`
+	RecoveryKeysB64       []string `json:"recovery_keys_b64"`
+	RecoveryKeysHex       []string `json:"recovery_keys_hex"`
+	RecoveryKeysShares    int      `json:"recovery_keys_shares"`
+	RecoveryKeysThreshold int      `json:"recovery_keys_threshold"`
+	RootToken             string   `json:"root_token"`
+}
+
+// Options for `vault operator init`. Zero values fall back to Vault's defaults of 5 key shares and a key threshold of 3.
+type VaultInitOptions struct {
+	KeyShares       int
+	KeyThreshold    int
+	PgpKeys         []*PgpKeyPair // One key per key share. Vault returns each unseal key encrypted with its key.
+	RootTokenPgpKey *PgpKeyPair   // Vault returns the root token encrypted with this key
 }
 
 // From: https://www.vaultproject.io/api/system/health.html
 type VaultStatus int
 
 const (
-	Leader        VaultStatus = 200
-	Standby                   = 429
-	Uninitialized             = 501
-	Sealed                    = 503
+	Leader             VaultStatus = 200
+	Standby            VaultStatus = 429
+	DrSecondary        VaultStatus = 472
+	PerformanceStandby VaultStatus = 473
+	Uninitialized      VaultStatus = 501
+	Sealed             VaultStatus = 503
 )
 
-// Initialize the Vault cluster and unseal each of the nodes by connecting to them over SSH and executing Vault
-// commands. The reason we use SSH rather than using the Vault client remotely is we want to verify that the
-// self-signed TLS certificate is properly configured on each server so when you're on that server, you don't
-// get errors about the certificate being signed by an unknown party.
+// Initialize the Vault cluster and unseal each of the nodes through the given transport. SshTransport runs Vault
+// commands on the nodes themselves, which also verifies that the self-signed TLS certificate is trusted on each server.
+// ApiTransport uses a Vault API client pointed at each node, for clusters whose nodes are reachable on the Vault port.
+// SSH access to the nodes is checked either way.
 // Adapted from https://github.com/hashicorp/terraform-aws-vault/blob/141f57642215820ff758200fe63b3a52d7017061/test/vault_helpers.go#L507
-func initializeAndUnsealVaultCluster(t *testing.T, projectId string, region string, instanceGroupName string, sshUserName string, sshKeyPair *ssh.KeyPair, bastionHost *ssh.Host) *VaultCluster {
-	cluster := findVaultClusterNodes(t, projectId, region, instanceGroupName, sshUserName, sshKeyPair, bastionHost)
+func initializeAndUnsealVaultCluster(t *testing.T, projectId string, region string, instanceGroupName string, clusterSize int, access *SshAccess, bastionHost *ssh.Host, transport VaultTransport, initOptions *VaultInitOptions) *VaultCluster {
+	cluster := findVaultClusterNodes(t, projectId, region, instanceGroupName, clusterSize, access, bastionHost)
+	cluster.Transport = transport
 
 	verifyCanSsh(t, cluster, bastionHost)
 	assertAllNodesBooted(t, cluster, bastionHost)
-	initOutput := initializeVault(t, cluster, bastionHost)
-	cluster.UnsealKeys = parseUnsealKeysFromVaultInitResponse(t, initOutput)
-
-	assertNodeStatus(t, cluster.Leader, bastionHost, Sealed)
-	unsealNode(t, cluster.Leader, bastionHost, cluster.UnsealKeys)
-	assertNodeStatus(t, cluster.Leader, bastionHost, Leader)
-
-	assertNodeStatus(t, cluster.Standby1, bastionHost, Sealed)
-	unsealNode(t, cluster.Standby1, bastionHost, cluster.UnsealKeys)
-	assertNodeStatus(t, cluster.Standby1, bastionHost, Standby)
+	initializeVault(t, cluster, bastionHost, initOptions)
+
+	// The first node to be unsealed grabs the HA lock and becomes the active node
+	initNode := cluster.NodeClient(t, cluster.InitNode(), bastionHost)
+	assertNodeStatus(t, initNode, Sealed)
+	unsealNode(t, initNode, cluster.UnsealKeys)
+	assertNodeStatus(t, initNode, Leader)
+
+	for _, node := range cluster.Nodes[1:] {
+		nodeClient := cluster.NodeClient(t, node, bastionHost)
+		assertNodeStatus(t, nodeClient, Sealed)
+		unsealNode(t, nodeClient, cluster.UnsealKeys)
+		assertNodeStatus(t, nodeClient, Standby)
+	}
 
-	assertNodeStatus(t, cluster.Standby2, bastionHost, Sealed)
-	unsealNode(t, cluster.Standby2, bastionHost, cluster.UnsealKeys)
-	assertNodeStatus(t, cluster.Standby2, bastionHost, Standby)
+	roles := discoverVaultClusterRoles(t, cluster, bastionHost)
+	logger.Logf(t, "Vault cluster roles after unsealing: active node is %s, standby nodes are %v", roles.Active.Hostname, getHostnames(roles.Standbys))
+	assertVaultClusterConsistent(t, cluster, bastionHost)
 
 	return cluster
 }
 
-// Find the nodes in the given Vault Instance Group and return them in a VaultCluster struct
-func findVaultClusterNodes(t *testing.T, projectId string, region string, instanceGroupName string, sshUserName string, sshKeyPair *ssh.KeyPair, bastionHost *ssh.Host) *VaultCluster {
+// Find the nodes in the given Vault Instance Group and return them in a VaultCluster struct that SSHes to them with the
+// given access
+func findVaultClusterNodes(t *testing.T, projectId string, region string, instanceGroupName string, clusterSize int, access *SshAccess, bastionHost *ssh.Host) *VaultCluster {
 	vaultInstanceGroup := gcp.FetchRegionalInstanceGroup(t, projectId, region, instanceGroupName)
-	hostnames := getClusterHostnames(t, projectId, vaultInstanceGroup, bastionHost)
+	hostnames := getClusterHostnames(t, projectId, vaultInstanceGroup, clusterSize, bastionHost)
 
-	return &VaultCluster{
-		Leader: ssh.Host{
-			Hostname:    hostnames[0],
-			SshUserName: sshUserName,
-			SshKeyPair:  sshKeyPair,
-		},
-
-		Standby1: ssh.Host{
-			Hostname:    hostnames[1],
-			SshUserName: sshUserName,
-			SshKeyPair:  sshKeyPair,
-		},
+	nodes := []ssh.Host{}
+	for _, hostname := range hostnames {
+		nodes = append(nodes, access.Host(hostname))
+	}
 
-		Standby2: ssh.Host{
-			Hostname:    hostnames[2],
-			SshUserName: sshUserName,
-			SshKeyPair:  sshKeyPair,
-		},
+	return &VaultCluster{
+		Nodes:     nodes,
+		SshAccess: access,
 	}
 }
 
 // Returns list of public ips of vault cluster or, if using bastion host + private instances, instance names
-func getClusterHostnames(t *testing.T, projectId string, vaultInstanceGroup *gcp.RegionalInstanceGroup, bastionHost *ssh.Host) []string {
+func getClusterHostnames(t *testing.T, projectId string, vaultInstanceGroup *gcp.RegionalInstanceGroup, clusterSize int, bastionHost *ssh.Host) []string {
 	hostnames := []string{}
 	if bastionHost != nil {
-		instances := getInstancesFromGroup(t, projectId, vaultInstanceGroup, 3)
+		instances := getInstancesFromGroup(t, projectId, vaultInstanceGroup, clusterSize)
 		for _, instance := range instances {
 			hostnames = append(hostnames, instance.Name)
 		}
@@ -114,8 +172,8 @@ func getClusterHostnames(t *testing.T, projectId string, vaultInstanceGroup *gcp
 		retry.DoWithRetry(t, "Getting public ips of instances in instance group", 10, 10*time.Second, func() (string, error) {
 			hostnames = vaultInstanceGroup.GetPublicIps(t, projectId)
 
-			if len(hostnames) != 3 {
-				return "", fmt.Errorf("Expected to get three IP addresses for Vault cluster, but got %d: %v", len(hostnames), hostnames)
+			if len(hostnames) != clusterSize {
+				return "", fmt.Errorf("Expected to get %d IP addresses for Vault cluster, but got %d: %v", clusterSize, len(hostnames), hostnames)
 			}
 			return "", nil
 		})
@@ -123,125 +181,503 @@ func getClusterHostnames(t *testing.T, projectId string, vaultInstanceGroup *gcp
 	return hostnames
 }
 
+// Read the number of Vault nodes the example was deployed with from the Terraform output
+func getClusterSize(t *testing.T, terraformOptions *terraform.Options) int {
+	clusterSizeOutput := terraform.OutputRequired(t, terraformOptions, TFOUT_VAULT_CLUSTER_SIZE)
+	clusterSize, err := strconv.Atoi(clusterSizeOutput)
+	if err != nil {
+		t.Fatalf("Failed to parse Vault cluster size from Terraform output %s: %v", clusterSizeOutput, err)
+	}
+	return clusterSize
+}
+
 // Wait until we can connect to each of the Vault cluster Instances
 func verifyCanSsh(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) {
-	for _, host := range cluster.GetSshHosts() {
-		if host.Hostname != "" {
+	cluster.RefreshSshAccess(t)
 
-			maxRetries := 30
-			sleepBetweenRetries := 10 * time.Second
-			description := fmt.Sprintf("Attempting SSH connection to %s\n", host.Hostname)
+	executors := map[string]Executor{}
+	for _, host := range cluster.GetSshHosts() {
+		executors[host.Hostname] = cluster.NodeExecutor(t, host, bastionHost)
+	}
 
-			retry.DoWithRetry(t, description, maxRetries, sleepBetweenRetries, func() (string, error) {
-				return runCommand(t, bastionHost, &host, "exit")
-			})
-		}
+	results := cluster.ForEachNode(DEFAULT_MAX_PARALLEL_NODES, func(host ssh.Host) (string, error) {
+		return "", waitForSshE(t, host.Hostname, executors[host.Hostname])
+	})
+	if err := results.Check(RequireAll); err != nil {
+		t.Fatalf("Failed to SSH to the Vault nodes: %v", err)
 	}
 }
 
-// Wait until the Vault servers are booted the very first time on the Compute Instances. As a simple solution, we simply
-// wait for the leader to boot and assume if it's up, the other nodes will be, too.
+// Wait until the Vault servers are booted the very first time on the Compute Instances, i.e. until every node reports
+// the uninitialized status. The nodes are waited for concurrently.
 func assertAllNodesBooted(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) {
+	nodeClients := map[string]VaultNodeClient{}
 	for _, node := range cluster.GetSshHosts() {
-		if node.Hostname != "" {
-			logger.Logf(t, "Waiting for Vault to boot the first time on host %s. Expecting it to be in uninitialized status (%d).", node.Hostname, int(Uninitialized))
-			assertNodeStatus(t, node, bastionHost, Uninitialized)
+		nodeClients[node.Hostname] = cluster.NodeClient(t, node, bastionHost)
+	}
+
+	results := cluster.ForEachNode(DEFAULT_MAX_PARALLEL_NODES, func(node ssh.Host) (string, error) {
+		logger.Logf(t, "Waiting for Vault to boot the first time on host %s. Expecting it to be in uninitialized status (%d).", node.Hostname, int(Uninitialized))
+		return waitForNodeStatusE(t, nodeClients[node.Hostname], Uninitialized)
+	})
+	if err := results.Check(RequireAll); err != nil {
+		t.Fatalf("Vault did not boot on all nodes: %v", err)
+	}
+}
+
+// Initialize the Vault cluster, filling in the unseal or recovery keys and the root token in the given vaultCluster
+// struct. If the given options contain PGP keys, the unseal keys and root token Vault returns are decrypted before
+// they are stored.
+func initializeVault(t *testing.T, vaultCluster *VaultCluster, bastionHost *ssh.Host, options *VaultInitOptions) *VaultInitResponse {
+	initNode := vaultCluster.NodeClient(t, vaultCluster.InitNode(), bastionHost)
+
+	var initResponse *VaultInitResponse
+	retry.DoWithRetry(t, "Initializing the cluster", 5, 5*time.Second, func() (string, error) {
+		response, err := initNode.Init(options)
+		if err != nil {
+			return "", retryOnlyConnectionErrors(err)
+		}
+		initResponse = response
+		return "", nil
+	})
+
+	if err := decryptVaultInitResponse(initResponse, options); err != nil {
+		t.Fatalf("Failed to decrypt the vault init output: %v", err)
+	}
+
+	vaultCluster.InitResponse = initResponse
+	vaultCluster.RootToken = initResponse.RootToken
+	if len(initResponse.UnsealKeysB64) > 0 {
+		vaultCluster.UnsealKeys = initResponse.UnsealKeysB64[:initResponse.UnsealThreshold]
+	}
+	if len(initResponse.RecoveryKeysB64) > 0 {
+		vaultCluster.RecoveryKeys = initResponse.RecoveryKeysB64[:initResponse.RecoveryKeysThreshold]
+	}
+	return initResponse
+}
+
+// Build the `vault operator init` command for the given options. Vault reads PGP keys from files, so the command first
+// writes the public keys to a temp folder on the node.
+func buildVaultInitCommand(options *VaultInitOptions) string {
+	initCommand := []string{"vault operator init -format=json"}
+	if options == nil {
+		return initCommand[0]
+	}
+
+	keyShares := options.KeyShares
+	if keyShares == 0 && len(options.PgpKeys) > 0 {
+		keyShares = len(options.PgpKeys)
+	}
+	if keyShares > 0 {
+		initCommand = append(initCommand, fmt.Sprintf("-key-shares=%d", keyShares))
+	}
+	if options.KeyThreshold > 0 {
+		initCommand = append(initCommand, fmt.Sprintf("-key-threshold=%d", options.KeyThreshold))
+	}
+
+	writeKeyCommands := []string{}
+	if len(options.PgpKeys) > 0 || options.RootTokenPgpKey != nil {
+		writeKeyCommands = append(writeKeyCommands, fmt.Sprintf("mkdir -p %s", VAULT_INIT_PGP_KEYS_DIR))
+	}
+
+	pgpKeyPaths := []string{}
+	for i, pgpKey := range options.PgpKeys {
+		path := fmt.Sprintf("%s/key-share-%d.b64", VAULT_INIT_PGP_KEYS_DIR, i)
+		writeKeyCommands = append(writeKeyCommands, fmt.Sprintf("echo -n '%s' > %s", pgpKey.PublicKey, path))
+		pgpKeyPaths = append(pgpKeyPaths, path)
+	}
+	if len(pgpKeyPaths) > 0 {
+		initCommand = append(initCommand, fmt.Sprintf("-pgp-keys=%s", strings.Join(pgpKeyPaths, ",")))
+	}
+
+	if options.RootTokenPgpKey != nil {
+		path := fmt.Sprintf("%s/root-token.b64", VAULT_INIT_PGP_KEYS_DIR)
+		writeKeyCommands = append(writeKeyCommands, fmt.Sprintf("echo -n '%s' > %s", options.RootTokenPgpKey.PublicKey, path))
+		initCommand = append(initCommand, fmt.Sprintf("-root-token-pgp-key=%s", path))
+	}
+
+	return strings.Join(append(writeKeyCommands, strings.Join(initCommand, " ")), " && ")
+}
+
+// Replace the PGP encrypted values in the given vault init response with their plaintext, using the private keys of the
+// PGP key pairs in the given options. Vault encrypts the hex encoding of each unseal key and the plain root token.
+func decryptVaultInitResponse(initResponse *VaultInitResponse, options *VaultInitOptions) error {
+	if options == nil {
+		return nil
+	}
+
+	if len(options.PgpKeys) > 0 {
+		if len(options.PgpKeys) != len(initResponse.UnsealKeysB64) {
+			return fmt.Errorf("Expected %d encrypted unseal keys, but got %d", len(options.PgpKeys), len(initResponse.UnsealKeysB64))
 		}
+
+		unsealKeysB64 := []string{}
+		unsealKeysHex := []string{}
+		for i, encryptedKey := range initResponse.UnsealKeysB64 {
+			unsealKeyHex, err := decryptWithPgpKey(encryptedKey, options.PgpKeys[i])
+			if err != nil {
+				return err
+			}
+			unsealKey, err := hex.DecodeString(unsealKeyHex)
+			if err != nil {
+				return fmt.Errorf("Decrypted unseal key %d is not hex encoded: %v", i+1, err)
+			}
+			unsealKeysHex = append(unsealKeysHex, unsealKeyHex)
+			unsealKeysB64 = append(unsealKeysB64, base64.StdEncoding.EncodeToString(unsealKey))
+		}
+		initResponse.UnsealKeysB64 = unsealKeysB64
+		initResponse.UnsealKeysHex = unsealKeysHex
 	}
+
+	if options.RootTokenPgpKey != nil {
+		rootToken, err := decryptWithPgpKey(initResponse.RootToken, options.RootTokenPgpKey)
+		if err != nil {
+			return err
+		}
+		initResponse.RootToken = rootToken
+	}
+
+	return nil
 }
 
-// Initialize the Vault cluster, filling in the unseal keys in the given vaultCluster struct
-func initializeVault(t *testing.T, vaultCluster *VaultCluster, bastionHost *ssh.Host) string {
-	return retry.DoWithRetry(t, "Initializing the cluster", 5, 5*time.Second, func() (string, error) {
-		output, err := runCommand(t, bastionHost, &vaultCluster.Leader, "vault operator init")
-		logger.Logf(t, "Vault init output: %s", output)
-		return output, err
+func testVaultIsEnterprise(t *testing.T, executor Executor) {
+	if _, err := testVaultIsEnterpriseE(t, executor); err != nil {
+		t.Fatalf("Failed to check the Vault version on host %s: %v", executor.Hostname(), err)
+	}
+}
+
+// Check that the vault binary on the given host is an enterprise build, retrying while the host can't be reached
+func testVaultIsEnterpriseE(t *testing.T, executor Executor) (string, error) {
+	return retry.DoWithRetryE(t, "Testing Vault Version", 3, 5*time.Second, func() (string, error) {
+		output, err := runCommand(executor, "vault --version")
+		if err != nil {
+			return "", retryOnlyConnectionErrors(err)
+		}
+		if !strings.Contains(output, "+ent") {
+			return "", retry.FatalError{Underlying: fmt.Errorf("This vault package is not the expected enterprise version. Actual version: %s", output)}
+		}
+		return output, nil
 	})
 }
 
-// Unseal the given Vault host using the given unseal keys
-func unsealNode(t *testing.T, host ssh.Host, bastionHost *ssh.Host, unsealKeys []string) {
-	unsealCommands := []string{}
-	for _, unsealKey := range unsealKeys {
-		unsealCommands = append(unsealCommands, fmt.Sprintf("vault operator unseal %s", unsealKey))
+// Restart Vault on the given host. Unless the cluster uses auto-unseal, Vault comes back sealed.
+func restartVault(t *testing.T, executor Executor) {
+	if _, err := restartVaultE(t, executor); err != nil {
+		t.Fatalf("Failed to restart Vault on host %s: %v", executor.Hostname(), err)
 	}
+}
 
-	unsealCommand := strings.Join(unsealCommands, " && ")
-	description := fmt.Sprintf("Unsealing Vault on host %s", host.Hostname)
-	retry.DoWithRetryE(t, description, 10, 10*time.Second, func() (string, error) {
-		return runCommand(t, bastionHost, &host, unsealCommand)
+// Restart Vault on the given host, retrying while the host can't be reached
+func restartVaultE(t *testing.T, executor Executor) (string, error) {
+	return retry.DoWithRetryE(t, "Restarting vault", 3, 5*time.Second, func() (string, error) {
+		output, err := runCommand(executor, "sudo supervisorctl restart vault")
+		logger.Logf(t, "Vault Restarting output: %s", output)
+		return output, retryOnlyConnectionErrors(err)
 	})
 }
 
-// Parse an unseal key from a single line of the stdout of the vault init command, which should be of the format:
+// Parse the stdout returned from the vault init command when run with -format=json. Clusters that use auto-unseal
+// return recovery keys instead of unseal keys. The format we're expecting is:
 //
-// Unseal Key 1: Gi9xAX9rFfmHtSi68mYOh0H3H2eu8E77nvRm/0fsuwQB
-func parseUnsealKey(t *testing.T, str string) string {
-	UnsealKeyRegex := regexp.MustCompile("^Unseal Key \\d: (.+)$")
-	matches := UnsealKeyRegex.FindStringSubmatch(str)
-	if len(matches) != 2 {
-		t.Fatalf("Unexpected format for unseal key: %s", str)
+//	{
+//	  "unseal_keys_b64": ["Gi9xAX9rFfmHtSi68mYOh0H3H2eu8E77nvRm/0fsuwQB", ...],
+//	  "unseal_keys_hex": ["1a2f71017f6b15f987b528baf2660e8741f71f67aef04efb9ef466ff47ecbb0401", ...],
+//	  "unseal_shares": 5,
+//	  "unseal_threshold": 3,
+//	  "recovery_keys_b64": [],
+//	  "recovery_keys_hex": [],
+//	  "recovery_keys_shares": 5,
+//	  "recovery_keys_threshold": 3,
+//	  "root_token": "s.Wq8I5mbqWgDr6Xk4y1Fgh3Yh"
+//	}
+func parseVaultInitResponse(t *testing.T, vaultInitResponse string) *VaultInitResponse {
+	initResponse, err := parseVaultInitResponseE(vaultInitResponse)
+	if err != nil {
+		t.Fatal(err)
 	}
-	return matches[1]
+	return initResponse
 }
 
-// Parse the unseal keys from the stdout returned from the vault init command.
-//
-// The format we're expecting is:
-//
-// Unseal Key 1: Gi9xAX9rFfmHtSi68mYOh0H3H2eu8E77nvRm/0fsuwQB
-// Unseal Key 2: ecQjHmaXc79GtwJN/hYWd/N2skhoNgyCmgCfGqRMTPIC
-// Unseal Key 3: LEOa/DdZDgLHBqK0JoxbviKByUAgxfm2dwK4y1PX6qED
-// Unseal Key 4: ZY87ijsj9/f5fO7ufgr4yhPWU/2ZZM3BGuSQRDFZpwoE
-// Unseal Key 5: MAiCaGrtikp4zU4XppC1A8IhKPXRlzj19+a3lcbCAVkF
-func parseUnsealKeysFromVaultInitResponse(t *testing.T, vaultInitResponse string) []string {
-	lines := strings.Split(vaultInitResponse, "\n")
-	if len(lines) < 3 {
-		t.Fatalf("Did not find at least three lines of in the vault init stdout: %s", vaultInitResponse)
+// Parse the stdout returned from the vault init command when run with -format=json, returning an error if it can't
+// be parsed
+func parseVaultInitResponseE(vaultInitResponse string) (*VaultInitResponse, error) {
+	var initResponse VaultInitResponse
+	if err := parseJsonFromCommandOutput(vaultInitResponse, &initResponse); err != nil {
+		return nil, fmt.Errorf("Failed to parse the vault init output: %v", err)
 	}
 
-	// By default, Vault requires 3 unseal keys out of 5, so just parse those first three
-	unsealKey1 := parseUnsealKey(t, lines[0])
-	unsealKey2 := parseUnsealKey(t, lines[1])
-	unsealKey3 := parseUnsealKey(t, lines[2])
+	if err := validateVaultInitResponse(&initResponse); err != nil {
+		return nil, fmt.Errorf("%v. Output: %s", err, vaultInitResponse)
+	}
+	return &initResponse, nil
+}
 
-	return []string{unsealKey1, unsealKey2, unsealKey3}
+// Check that the given init response has a root token and the number of keys it says it has
+func validateVaultInitResponse(initResponse *VaultInitResponse) error {
+	if initResponse.RootToken == "" {
+		return fmt.Errorf("Did not find a root token in the vault init response")
+	}
+	// Clusters that use auto-unseal return recovery keys instead of unseal keys, but still echo the default share
+	// counts for both, so only check the counts of the keys we actually got back
+	if len(initResponse.UnsealKeysB64) == 0 && len(initResponse.RecoveryKeysB64) == 0 {
+		return fmt.Errorf("Did not find any unseal or recovery keys in the vault init response")
+	}
+	if len(initResponse.UnsealKeysB64) > 0 && len(initResponse.UnsealKeysB64) != initResponse.UnsealShares {
+		return fmt.Errorf("Expected %d unseal keys in the vault init response, but got %d", initResponse.UnsealShares, len(initResponse.UnsealKeysB64))
+	}
+	if len(initResponse.RecoveryKeysB64) > 0 && len(initResponse.RecoveryKeysB64) != initResponse.RecoveryKeysShares {
+		return fmt.Errorf("Expected %d recovery keys in the vault init response, but got %d", initResponse.RecoveryKeysShares, len(initResponse.RecoveryKeysB64))
+	}
+	return nil
+}
+
+// Parse the JSON object in the output of a Vault command run with -format=json into the given target. Anything Vault
+// prints to stdout around the JSON object is ignored.
+func parseJsonFromCommandOutput(output string, target interface{}) error {
+	start := strings.Index(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return fmt.Errorf("Did not find a JSON object in the command output: %s", output)
+	}
+
+	if err := json.Unmarshal([]byte(output[start:end+1]), target); err != nil {
+		return fmt.Errorf("%v. Output: %s", err, output)
+	}
+	return nil
 }
 
 // Check that the given Vault node has the given status
-func assertNodeStatus(t *testing.T, host ssh.Host, bastionHost *ssh.Host, expectedStatus VaultStatus) {
+func assertNodeStatus(t *testing.T, node VaultNodeClient, expectedStatus VaultStatus) {
+	out, err := waitForNodeStatusE(t, node, expectedStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Logf(t, out)
+}
 
+// Wait for the given Vault node to have the given status, and return an error if it doesn't get it in time
+func waitForNodeStatusE(t *testing.T, node VaultNodeClient, expectedStatus VaultStatus) (string, error) {
 	maxRetries := 30
 	sleepBetweenRetries := 10 * time.Second
-	description := fmt.Sprintf("Check that the Vault node %s has status %d", host.Hostname, int(expectedStatus))
+	description := fmt.Sprintf("Check that the Vault node %s has status %d", node.Hostname(), int(expectedStatus))
 
-	out := retry.DoWithRetry(t, description, maxRetries, sleepBetweenRetries, func() (string, error) {
-		return checkStatus(t, host, bastionHost, expectedStatus)
+	return retry.DoWithRetryE(t, description, maxRetries, sleepBetweenRetries, func() (string, error) {
+		return checkStatus(node, expectedStatus)
+	})
+}
+
+// Check the status of the given Vault node and ensure it matches the expected status, and that the health response
+// agrees with it. Note that over the SSH transport we use curl to do the status check so we can ensure that TLS
+// certificates work for curl (and not just the Vault client).
+func checkStatus(node VaultNodeClient, expectedStatus VaultStatus) (string, error) {
+	health, err := node.Health()
+	if err != nil {
+		return "", retryOnlyConnectionErrors(err)
+	}
+
+	if health.StatusCode != expectedStatus {
+		return "", fmt.Errorf("Expected status code %d for host %s, but got %d", int(expectedStatus), node.Hostname(), int(health.StatusCode))
+	}
+	if err := checkHealthMatchesStatus(health); err != nil {
+		return "", fmt.Errorf("Unexpected health of host %s: %v", node.Hostname(), err)
+	}
+	return fmt.Sprintf("Got expected status code %d", int(health.StatusCode)), nil
+}
+
+// Ask every node in the cluster for its role and return the active node and the standby nodes. Retries until exactly
+// one node claims to be active, as it can take a while for a standby to take over the HA lock after a failover.
+func discoverVaultClusterRoles(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) *VaultClusterRoles {
+	maxRetries := 30
+	sleepBetweenRetries := 10 * time.Second
+
+	var roles *VaultClusterRoles
+	retry.DoWithRetry(t, "Discovering the roles of the Vault cluster nodes", maxRetries, sleepBetweenRetries, func() (string, error) {
+		discovered, err := discoverVaultClusterRolesE(t, cluster, bastionHost)
+		if err != nil {
+			return "", err
+		}
+		roles = discovered
+		return fmt.Sprintf("Active Vault node is %s", roles.Active.Hostname), nil
+	})
+
+	return roles
+}
+
+// Ask every node in the cluster for its role using /v1/sys/health and /v1/sys/leader. A node is active if its health
+// endpoint returns the active status code and it reports itself as the leader; it is a standby if its health endpoint
+// returns the standby status code and it reports some other node as the leader.
+func discoverVaultClusterRolesE(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) (*VaultClusterRoles, error) {
+	activeNodes := []ssh.Host{}
+	standbyNodes := []ssh.Host{}
+
+	for _, node := range cluster.GetSshHosts() {
+		nodeClient := cluster.NodeClient(t, node, bastionHost)
+		health, err := nodeClient.Health()
+		if err != nil {
+			return nil, retryOnlyConnectionErrors(err)
+		}
+
+		leader, err := nodeClient.Leader()
+		if err != nil {
+			return nil, retryOnlyConnectionErrors(err)
+		}
+
+		switch {
+		case health.StatusCode == Leader && !health.Standby && leader.IsSelf:
+			activeNodes = append(activeNodes, node)
+		case (health.StatusCode == Standby || health.StatusCode == PerformanceStandby) && health.Standby && !leader.IsSelf && leader.LeaderAddress != "":
+			standbyNodes = append(standbyNodes, node)
+		default:
+			return nil, fmt.Errorf("Vault node %s has no clear role: health status code %d, standby %t, is_self %t, leader_address %q", node.Hostname, int(health.StatusCode), health.Standby, leader.IsSelf, leader.LeaderAddress)
+		}
+	}
+
+	if len(activeNodes) != 1 {
+		return nil, fmt.Errorf("Expected exactly one active Vault node, but found %d: %v", len(activeNodes), getHostnames(activeNodes))
+	}
+
+	return &VaultClusterRoles{
+		Active:   activeNodes[0],
+		Standbys: standbyNodes,
+	}, nil
+}
+
+// What a Vault node reports about the cluster it belongs to. Nodes that formed one cluster report the same values.
+type VaultNodeClusterInfo struct {
+	ClusterId     string
+	ClusterName   string
+	Version       string
+	LeaderAddress string
+}
+
+// Check that every node in the cluster reports the same cluster_id, cluster_name, version and leader address, to make
+// sure the nodes formed one cluster rather than being independent Vault servers sharing a storage backend. Retries for
+// a while, as the leader address can briefly disagree after a failover.
+func assertVaultClusterConsistent(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) {
+	maxRetries := 10
+	sleepBetweenRetries := 10 * time.Second
+
+	out := retry.DoWithRetry(t, "Check that all Vault nodes formed one cluster", maxRetries, sleepBetweenRetries, func() (string, error) {
+		info, err := getVaultClusterInfoE(t, cluster, bastionHost)
+		if err != nil {
+			return "", err
+		}
+		if err := checkVaultClusterInfoConsistent(info); err != nil {
+			return "", err
+		}
+		first := info[cluster.Nodes[0].Hostname]
+		return fmt.Sprintf("All %d Vault nodes belong to cluster %s (%s) running version %s with leader %s", len(info), first.ClusterName, first.ClusterId, first.Version, first.LeaderAddress), nil
 	})
 
 	logger.Logf(t, out)
 }
 
-// Check the status of the given Vault node and ensure it matches the expected status. Note that we use curl to do the
-// status check so we can ensure that TLS certificates work for curl (and not just the Vault client).
-func checkStatus(t *testing.T, host ssh.Host, bastionHost *ssh.Host, expectedStatus VaultStatus) (string, error) {
-	curlCommand := "curl -s -o /dev/null -w '%{http_code}' https://127.0.0.1:8200/v1/sys/health"
-	logger.Logf(t, "Using curl to check status of Vault server %s: %s", host.Hostname, curlCommand)
+// Collect what every node in the cluster reports about the cluster it belongs to from /v1/sys/health and
+// /v1/sys/leader, keyed by hostname
+func getVaultClusterInfoE(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) (map[string]VaultNodeClusterInfo, error) {
+	nodeClients := map[string]VaultNodeClient{}
+	for _, node := range cluster.GetSshHosts() {
+		nodeClients[node.Hostname] = cluster.NodeClient(t, node, bastionHost)
+	}
+
+	info := map[string]VaultNodeClusterInfo{}
+	var mutex sync.Mutex
 
-	output, err := runCommand(t, bastionHost, &host, curlCommand)
-	if err != nil {
-		return output, err
+	results := cluster.ForEachNode(DEFAULT_MAX_PARALLEL_NODES, func(node ssh.Host) (string, error) {
+		nodeClient := nodeClients[node.Hostname]
+		health, err := nodeClient.Health()
+		if err != nil {
+			return "", err
+		}
+
+		leader, err := nodeClient.Leader()
+		if err != nil {
+			return "", err
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		info[node.Hostname] = VaultNodeClusterInfo{
+			ClusterId:     health.ClusterId,
+			ClusterName:   health.ClusterName,
+			Version:       health.Version,
+			LeaderAddress: leader.LeaderAddress,
+		}
+		return "", nil
+	})
+	if err := results.Check(RequireAll); err != nil {
+		for _, hostname := range results.Failed() {
+			if !isConnectionError(results[hostname].Err) {
+				return nil, retry.FatalError{Underlying: err}
+			}
+		}
+		return nil, err
 	}
-	status, err := strconv.Atoi(output)
+
+	return info, nil
+}
+
+// Check that all nodes reported the same, non-empty cluster info. Returns an error with the value of every node for
+// each field the nodes disagree on.
+func checkVaultClusterInfoConsistent(info map[string]VaultNodeClusterInfo) error {
+	hostnames := []string{}
+	for hostname := range info {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	fields := []struct {
+		name  string
+		value func(VaultNodeClusterInfo) string
+	}{
+		{"cluster_id", func(i VaultNodeClusterInfo) string { return i.ClusterId }},
+		{"cluster_name", func(i VaultNodeClusterInfo) string { return i.ClusterName }},
+		{"version", func(i VaultNodeClusterInfo) string { return i.Version }},
+		{"leader_address", func(i VaultNodeClusterInfo) string { return i.LeaderAddress }},
+	}
+
+	diffs := []string{}
+	for _, field := range fields {
+		values := map[string]bool{}
+		lines := []string{}
+		for _, hostname := range hostnames {
+			value := field.value(info[hostname])
+			values[value] = true
+			lines = append(lines, fmt.Sprintf("    %s: %q", hostname, value))
+		}
+
+		if len(values) > 1 || values[""] {
+			diffs = append(diffs, fmt.Sprintf("  %s:\n%s", field.name, strings.Join(lines, "\n")))
+		}
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("Vault nodes did not report the same non-empty cluster info:\n%s", strings.Join(diffs, "\n"))
+	}
+	return nil
+}
+
+// Use curl to read /v1/sys/leader on the given Vault node
+func getNodeLeader(t *testing.T, executor Executor) (*api.LeaderResponse, error) {
+	curlCommand := "curl -s https://127.0.0.1:8200/v1/sys/leader"
+	output, err := runCommand(executor, curlCommand)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if status == int(expectedStatus) {
-		return fmt.Sprintf("Got expected status code %d", status), nil
-	} else {
-		return "", fmt.Errorf("Expected status code %d for host %s, but got %d", int(expectedStatus), host.Hostname, status)
+	var leader api.LeaderResponse
+	if err := json.Unmarshal([]byte(output), &leader); err != nil {
+		return nil, fmt.Errorf("Failed to parse /v1/sys/leader response from host %s: %v. Response: %s", executor.Hostname(), err, output)
 	}
+	return &leader, nil
+}
+
+func getHostnames(hosts []ssh.Host) []string {
+	hostnames := []string{}
+	for _, host := range hosts {
+		hostnames = append(hostnames, host.Hostname)
+	}
+	return hostnames
 }
 
 // Use the Vault client to connect to the Vault cluster via the public DNS entry, and make sure it works without
@@ -269,14 +705,52 @@ func testVault(t *testing.T, domainName string) {
 	logger.Logf(t, out)
 }
 
-// Create a Vault client configured to talk to Vault running at the given domain name
+// Create a Vault client configured to talk to Vault running at the given domain name, which verifies the cert baked
+// into the Vault images
 func createVaultClient(t *testing.T, domainName string) *api.Client {
+	return createVaultClientForAddress(t, fmt.Sprintf("https://%s:%d", domainName, VAULT_PORT), getDefaultVaultTlsConfig(t))
+}
+
+// Returns the TLS config that verifies the cert baked into the Vault images: it trusts the CA of the test cert, and
+// checks the cert is valid for vault.service.consul, as the tests reach the nodes by IP
+func getDefaultVaultTlsConfig(t *testing.T) *api.TLSConfig {
+	return &api.TLSConfig{
+		CACert:        loadTLSCert(t, WORK_DIR).CAPublicKeyPath,
+		TLSServerName: VAULT_TLS_SERVER_NAME,
+	}
+}
+
+// Returns a copy of the given TLS config that presents the given client cert, for Vault listeners that run with
+// --tls-require-and-verify-client-cert
+func getVaultClientCertTlsConfig(tlsConfig *api.TLSConfig, clientTlsCert ClientTlsCert) *api.TLSConfig {
+	clientCertTlsConfig := *tlsConfig
+	clientCertTlsConfig.ClientCert = clientTlsCert.PublicKeyPath
+	clientCertTlsConfig.ClientKey = clientTlsCert.PrivateKeyPath
+	return &clientCertTlsConfig
+}
+
+// Create a Vault client configured to talk to Vault at the given address, e.g. https://127.0.0.1:8200, which verifies
+// the cert of the server with the given TLS config. To skip the verification, Insecure has to be set in the config.
+func createVaultClientForAddress(t *testing.T, address string, tlsConfig *api.TLSConfig) *api.Client {
+	if tlsConfig == nil {
+		t.Fatalf("No TLS config for the Vault client for %s. Set Insecure in it to skip verifying the cert of the server.", address)
+	}
+
 	config := api.DefaultConfig()
-	config.Address = fmt.Sprintf("https://%s:%d", domainName, VAULT_PORT)
+	if config.Error != nil {
+		t.Fatalf("Failed to create Vault client config: %v", config.Error)
+	}
+	config.Address = address
 
-	// The TLS cert we are using in this test does not have the instance DNS name in it, so disable the TLS check
+	if err := config.ConfigureTLS(tlsConfig); err != nil {
+		t.Fatalf("Failed to configure TLS for the Vault client for %s: %v", address, err)
+	}
+	// The default config skips verification if VAULT_SKIP_VERIFY is set, so only the given config decides that
 	clientTLSConfig := config.HttpClient.Transport.(*http.Transport).TLSClientConfig
-	clientTLSConfig.InsecureSkipVerify = true
+	clientTLSConfig.InsecureSkipVerify = tlsConfig.Insecure
+	if tlsConfig.Insecure {
+		logger.Logf(t, "WARNING: Not verifying the TLS cert of Vault at %s", address)
+	}
 
 	client, err := api.NewClient(config)
 	if err != nil {
@@ -290,7 +764,8 @@ func createVaultClient(t *testing.T, domainName string) *api.Client {
 // domain name works.
 func testVaultUsesConsulForDns(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) {
 	// Pick any host, it shouldn't matter
-	host := cluster.Standby1
+	host := cluster.Nodes[0]
+	executor := cluster.NodeExecutor(t, host, bastionHost)
 
 	command := "vault status -address=https://vault.service.consul:8200"
 	description := fmt.Sprintf("Checking that the Vault server at %s is properly configured to use Consul for DNS: %s", host.Hostname, command)
@@ -300,42 +775,13 @@ func testVaultUsesConsulForDns(t *testing.T, cluster *VaultCluster, bastionHost
 	sleepBetweenRetries := 5 * time.Second
 
 	_, err := retry.DoWithRetryE(t, description, maxRetries, sleepBetweenRetries, func() (string, error) {
-		o, e := runCommand(t, bastionHost, &host, command)
+		o, e := runCommand(executor, command)
 		logger.Logf(t, "Output from command vault status call to vault.service.consul: %s", o)
-		return o, e
+		// Failing to resolve vault.service.consul makes the vault CLI fail to dial, which is retried as a connection error
+		return o, retryOnlyConnectionErrors(e)
 	})
 
 	if err != nil {
 		t.Fatalf("Failed to run vault command with vault.service.consul URL due to error: %v", err)
 	}
 }
-
-// Gets Vault logs and syslog written to disk, so it is exposed on circle ci artifacts
-func writeVaultLogs(t *testing.T, testName string, testDir string) {
-	terraformOptions := test_structure.LoadTerraformOptions(t, testDir)
-
-	keyPair := loadKeyPair(t, testDir)
-	projectId := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_PROJECT_ID)
-	region := test_structure.LoadString(t, WORK_DIR, SAVED_GCP_REGION_NAME)
-	instanceGroupName := terraform.OutputRequired(t, terraformOptions, TFOUT_INSTANCE_GROUP_NAME)
-	instanceGroup := gcp.FetchRegionalInstanceGroup(t, projectId, region, instanceGroupName)
-	instances := getInstancesFromGroup(t, projectId, instanceGroup, 3)
-
-	vaultStdOutLogFilePath := "/opt/vault/log/vault-stdout.log"
-	vaultStdErrLogFilePath := "/opt/vault/log/vault-error.log"
-	sysLogFilePath := "/var/log/syslog"
-
-	instanceIdToLogs := map[string]map[string]string{}
-	for _, instance := range instances {
-		instanceName := instance.Name
-		instanceIdToLogs[instanceName] = getFilesFromInstance(t, instance, &keyPair, vaultStdOutLogFilePath, vaultStdErrLogFilePath, sysLogFilePath)
-
-		localDestDir := filepath.Join(LOGS_STORAGE_PATH, testName, instanceName)
-		if !files.FileExists(localDestDir) {
-			os.MkdirAll(localDestDir, 0755)
-		}
-		writeLogFile(t, instanceIdToLogs[instanceName][vaultStdOutLogFilePath], filepath.Join(localDestDir, "vault-stdout.log"))
-		writeLogFile(t, instanceIdToLogs[instanceName][vaultStdErrLogFilePath], filepath.Join(localDestDir, "vault-error.log"))
-		writeLogFile(t, instanceIdToLogs[instanceName][sysLogFilePath], filepath.Join(localDestDir, "syslog"))
-	}
-}
@@ -0,0 +1,135 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/retry"
+)
+
+func TestCheckStatus(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		description   string
+		script        ScriptedCommand
+		expected      VaultStatus
+		expectedError string // Empty if the check has to pass
+		fatal         bool   // Whether retrying can't fix the error
+	}{
+		{"active node", ScriptedCommand{Output: `{"initialized":true,"sealed":false,"standby":false}` + "\n200"}, Leader, "", false},
+		{"standby node", ScriptedCommand{Output: `{"initialized":true,"sealed":false,"standby":true}` + "\n429"}, Leader, "Expected status code 200 for host vault-node-0, but got 429", false},
+		{"body that disagrees with the status", ScriptedCommand{Output: `{"initialized":true,"sealed":false,"standby":false}` + "\n503"}, Sealed, "Unexpected health of host vault-node-0", false},
+		{"Vault that isn't listening yet", ScriptedCommand{Output: "\n000", ExitCode: 7}, Uninitialized, "exited with status 7", false},
+		{"response that isn't from Vault", ScriptedCommand{Output: "<html>Bad Gateway</html>\n502"}, Leader, "Failed to parse /v1/sys/health response from host vault-node-0", true},
+		{"curl that doesn't trust the cert", ScriptedCommand{Output: "\n000", Stderr: "curl: (60) SSL certificate problem\n", ExitCode: 60}, Leader, "SSL certificate problem", true},
+	}
+
+	for _, testCase := range testCases {
+		testCase.script.Match = `/v1/sys/health'$`
+		node := &SshVaultNodeClient{t: t, executor: &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{testCase.script}}}
+
+		_, err := checkStatus(node, testCase.expected)
+		if testCase.expectedError == "" {
+			if err != nil {
+				t.Errorf("Expected the status check of a %s to pass, but got: %v", testCase.description, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+			t.Errorf("Expected the status check of a %s to fail with %q, but got: %v", testCase.description, testCase.expectedError, err)
+			continue
+		}
+		if _, fatal := err.(retry.FatalError); fatal != testCase.fatal {
+			t.Errorf("Expected the error for a %s to be fatal: %t, but got: %v", testCase.description, testCase.fatal, err)
+		}
+	}
+}
+
+func TestWaitForNodeStatusStopsOnFatalError(t *testing.T) {
+	t.Parallel()
+
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `/v1/sys/health'$`, Output: "<html>Bad Gateway</html>\n502"},
+	}}
+	node := &SshVaultNodeClient{t: t, executor: executor}
+
+	if _, err := waitForNodeStatusE(t, node, Leader); err == nil {
+		t.Fatal("Expected a response that isn't from Vault to fail")
+	}
+	if len(executor.Commands) != 1 {
+		t.Fatalf("Expected the status to be checked once, but it was checked %d times", len(executor.Commands))
+	}
+}
+
+func TestRestartVaultRetriesUntilNodeCanBeReached(t *testing.T) {
+	t.Parallel()
+
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^sudo supervisorctl restart vault$`, Err: &ConnectionError{Hostname: "vault-node-0", Err: fmt.Errorf("connection refused")}},
+		{Match: `^sudo supervisorctl restart vault$`, Output: "vault: stopped\nvault: started\n"},
+	}}
+
+	restartVault(t, executor)
+
+	if err := executor.CheckScriptDone(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestartVaultFailsRightAwayWhenCommandFails(t *testing.T) {
+	t.Parallel()
+
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^sudo supervisorctl restart vault$`, Output: "vault: ERROR (no such process)\n", ExitCode: 1},
+	}}
+
+	_, err := restartVaultE(t, executor)
+	if _, ok := err.(retry.FatalError); !ok {
+		t.Fatalf("Expected a failed restart to be a retry.FatalError, but got: %v", err)
+	}
+	if len(executor.Commands) != 1 {
+		t.Fatalf("Expected the restart to be run once, but it was run %d times", len(executor.Commands))
+	}
+}
+
+func TestVaultIsEnterprise(t *testing.T) {
+	t.Parallel()
+
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^vault --version$`, Output: "Vault v0.11.5+ent ('a1b2c3')\n"},
+	}}
+
+	testVaultIsEnterprise(t, executor)
+}
+
+func TestVaultIsEnterpriseFailsOnOpenSourceVault(t *testing.T) {
+	t.Parallel()
+
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^vault --version$`, Output: "Vault v0.11.5 ('a1b2c3')\n"},
+	}}
+
+	_, err := testVaultIsEnterpriseE(t, executor)
+	if _, ok := err.(retry.FatalError); !ok || !strings.Contains(err.Error(), "Actual version: Vault v0.11.5 ('a1b2c3')") {
+		t.Fatalf("Expected an open source version to fail without retrying, but got: %v", err)
+	}
+	if len(executor.Commands) != 1 {
+		t.Fatalf("Expected the version to be checked once, but it was checked %d times", len(executor.Commands))
+	}
+}
+
+func TestVaultIsEnterpriseFailsWhenVaultIsMissing(t *testing.T) {
+	t.Parallel()
+
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^vault --version$`, Stderr: "bash: vault: command not found\n", ExitCode: 127},
+	}}
+
+	_, err := testVaultIsEnterpriseE(t, executor)
+	if _, ok := err.(retry.FatalError); !ok || !strings.Contains(err.Error(), "command not found") {
+		t.Fatalf("Expected a missing vault binary to fail without retrying, but got: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/files"
+	"github.com/gruntwork-io/terratest/modules/gcp"
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+// The name of the file that lists the entries of the manifest that couldn't be collected from a node
+const MISSING_LOGS_FILE_NAME = "missing-logs.txt"
+
+// A file, or the output of a command, to collect from each Vault node so it's exposed on circle ci artifacts. Exactly
+// one of Path and Command has to be set.
+type VaultLogEntry struct {
+	Name    string // Name of the file the contents are written to, which has to be unique in the manifest
+	Path    string // Path of the file to collect on the node
+	Command string // Command to run on the node to collect its output
+	Sudo    bool   // Read the file or run the command with sudo
+}
+
+// Returns the command that collects this entry on a node
+func (e VaultLogEntry) command() string {
+	command := e.Command
+	if e.Path != "" {
+		command = fmt.Sprintf("cat '%s'", e.Path)
+	}
+	if e.Sudo {
+		command = "sudo " + command
+	}
+	return command
+}
+
+// Returns what this entry collects, for use in logs and error messages
+func (e VaultLogEntry) String() string {
+	if e.Path != "" {
+		return fmt.Sprintf("%s (file %s)", e.Name, e.Path)
+	}
+	return fmt.Sprintf("%s (command `%s`)", e.Name, e.Command)
+}
+
+// The files and command output to collect from each Vault node of a test
+type VaultLogManifest []VaultLogEntry
+
+// Returns a copy of this manifest with the given entries added, so a test can collect more than the default
+func (m VaultLogManifest) With(entries ...VaultLogEntry) VaultLogManifest {
+	manifest := append(VaultLogManifest{}, m...)
+	return append(manifest, entries...)
+}
+
+// Check that every entry has a unique name and sets exactly one of Path and Command
+func (m VaultLogManifest) Validate() error {
+	names := map[string]bool{}
+	for i, entry := range m {
+		if entry.Name == "" {
+			return fmt.Errorf("Log entry %d has no name", i+1)
+		}
+		if names[entry.Name] {
+			return fmt.Errorf("Log entry %d has the same name as an earlier entry: %s", i+1, entry.Name)
+		}
+		names[entry.Name] = true
+
+		if (entry.Path == "") == (entry.Command == "") {
+			return fmt.Errorf("Log entry %s has to set exactly one of Path and Command", entry.Name)
+		}
+	}
+	return nil
+}
+
+// Returns the logs, config files and process status that every Vault node of the examples has. Vault, Consul and
+// supervisor are all installed by the install scripts of the vault-consul-image example.
+func getDefaultVaultLogManifest() VaultLogManifest {
+	return VaultLogManifest{
+		{Name: "vault-stdout.log", Path: "/opt/vault/log/vault-stdout.log"},
+		{Name: "vault-error.log", Path: "/opt/vault/log/vault-error.log"},
+		{Name: "vault-config.hcl", Path: "/opt/vault/config/default.hcl", Sudo: true},
+		{Name: "consul-stdout.log", Path: "/opt/consul/log/consul-stdout.log"},
+		{Name: "consul-error.log", Path: "/opt/consul/log/consul-error.log"},
+		{Name: "supervisord.log", Path: "/var/log/supervisor/supervisord.log", Sudo: true},
+		{Name: "supervisor-run-vault.conf", Path: "/etc/supervisor/conf.d/run-vault.conf"},
+		{Name: "supervisorctl-status.txt", Command: "supervisorctl status", Sudo: true},
+		{Name: "startup-script.log", Path: "/var/log/startup-script.log", Sudo: true},
+		{Name: "syslog", Path: "/var/log/syslog"},
+	}
+}
+
+// Gets the entries of the given manifest from every Vault node and writes them to disk, so they are exposed on circle
+// ci artifacts. The nodes are reached with the SSH access saved for the test, through its bastion host if it has one,
+// so the logs of the private clusters can be collected too.
+func writeVaultLogs(t *testing.T, testName string, testDir string, manifest VaultLogManifest) {
+	// Don't add a failure to the one of the deploy stage if it failed before there was SSH access to collect logs with
+	if !isSshAccessSaved(t, testDir) {
+		logger.Logf(t, "No SSH access was saved, so no logs can be collected")
+		return
+	}
+	access := loadSshAccess(t, testDir)
+
+	// Nodes the instance group recreated during the test don't have the key yet. Still collect what we can from the
+	// others if that fails.
+	if err := access.RefreshE(t); err != nil {
+		logger.Logf(t, "Failed to refresh SSH access to collect logs: %v", err)
+	}
+	bastionHost := access.BastionHost(t)
+
+	instanceGroup := gcp.FetchRegionalInstanceGroup(t, access.ProjectId, access.Region, access.InstanceGroupName)
+	instances := getInstancesFromGroup(t, access.ProjectId, instanceGroup, access.ClusterSize)
+
+	executors := map[string]Executor{}
+	instanceNames := []string{}
+	for _, instance := range instances {
+		node := access.Host(instance.Name)
+		if bastionHost == nil {
+			node.Hostname = instance.GetPublicIp(t)
+		}
+		executors[instance.Name] = newSshExecutor(node, bastionHost)
+		instanceNames = append(instanceNames, instance.Name)
+	}
+
+	// Fetch the logs of all nodes at the same time, so a slow or unreachable node doesn't hold up the others
+	runConcurrently(instanceNames, DEFAULT_MAX_PARALLEL_NODES, func(instanceName string) (string, error) {
+		writeVaultNodeLogs(t, testName, instanceName, executors[instanceName], manifest)
+		return "", nil
+	})
+}
+
+// Gets the entries of the given manifest from a single node with the given executor and writes them to disk under the
+// given node name. The entries that couldn't be collected are listed in MISSING_LOGS_FILE_NAME next to them.
+func writeVaultNodeLogs(t *testing.T, testName string, nodeName string, executor Executor, manifest VaultLogManifest) {
+	logs, missing := collectVaultLogs(t, executor, manifest)
+
+	localDestDir := filepath.Join(LOGS_STORAGE_PATH, testName, nodeName)
+	if !files.FileExists(localDestDir) {
+		os.MkdirAll(localDestDir, 0755)
+	}
+	for _, entry := range manifest {
+		if contents, ok := logs[entry.Name]; ok {
+			writeLogFile(t, contents, filepath.Join(localDestDir, entry.Name))
+		}
+	}
+
+	if len(missing) > 0 {
+		logger.Logf(t, "Failed to collect %d of %d log entries from %s:\n%s", len(missing), len(manifest), nodeName, strings.Join(missing, "\n"))
+		writeLogFile(t, strings.Join(missing, "\n")+"\n", filepath.Join(localDestDir, MISSING_LOGS_FILE_NAME))
+	}
+}
+
+// Collect the entries of the given manifest with the given executor. Returns the contents of the collected entries
+// keyed by name, and a description of each entry that couldn't be collected. The stdout of a command that exits with
+// an error is still returned, as e.g. `supervisorctl status` exits with an error when a process isn't running.
+func collectVaultLogs(t *testing.T, executor Executor, manifest VaultLogManifest) (map[string]string, []string) {
+	logs := map[string]string{}
+	missing := []string{}
+
+	if err := manifest.Validate(); err != nil {
+		return logs, []string{fmt.Sprintf("Invalid log manifest: %v", err)}
+	}
+
+	for _, entry := range manifest {
+		result, err := executor.Exec(entry.command())
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("%s: %v", entry, err))
+			if entry.Command == "" || result == nil {
+				continue
+			}
+		}
+		logs[entry.Name] = result.Stdout
+	}
+
+	return logs, missing
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCollectVaultLogsReportsMissingEntries(t *testing.T) {
+	t.Parallel()
+
+	manifest := VaultLogManifest{
+		{Name: "vault-stdout.log", Path: "/opt/vault/log/vault-stdout.log"},
+		{Name: "startup-script.log", Path: "/var/log/startup-script.log", Sudo: true},
+		{Name: "supervisorctl-status.txt", Command: "supervisorctl status", Sudo: true},
+	}
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: `^cat '/opt/vault/log/vault-stdout.log'$`, Output: "==> Vault server started!\n"},
+		{Match: `^sudo cat '/var/log/startup-script.log'$`, Stderr: "cat: /var/log/startup-script.log: No such file or directory\n", ExitCode: 1},
+		{Match: `^sudo supervisorctl status$`, Output: "vault    STOPPED\n", ExitCode: 3},
+	}}
+
+	logs, missing := collectVaultLogs(t, executor, manifest)
+
+	if logs["vault-stdout.log"] != "==> Vault server started!\n" {
+		t.Fatalf("Unexpected contents of vault-stdout.log: %q", logs["vault-stdout.log"])
+	}
+	if _, ok := logs["startup-script.log"]; ok {
+		t.Fatal("Expected startup-script.log, which could not be read, to be left out")
+	}
+	if logs["supervisorctl-status.txt"] != "vault    STOPPED\n" {
+		t.Fatalf("Expected the output of a failed command to be kept, but got: %q", logs["supervisorctl-status.txt"])
+	}
+
+	if len(missing) != 2 || !strings.Contains(missing[0], "No such file or directory") || !strings.Contains(missing[1], "supervisorctl status") {
+		t.Fatalf("Expected startup-script.log and supervisorctl status to be reported as missing, but got: %v", missing)
+	}
+	if err := executor.CheckScriptDone(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultLogManifestValidate(t *testing.T) {
+	t.Parallel()
+
+	if err := getDefaultVaultLogManifest().Validate(); err != nil {
+		t.Fatalf("Expected the default manifest to be valid: %v", err)
+	}
+
+	invalidManifests := []VaultLogManifest{
+		{{Path: "/var/log/syslog"}},
+		{{Name: "syslog"}},
+		{{Name: "syslog", Path: "/var/log/syslog", Command: "journalctl"}},
+		getDefaultVaultLogManifest().With(VaultLogEntry{Name: "syslog", Command: "journalctl"}),
+	}
+	for _, manifest := range invalidManifests {
+		if err := manifest.Validate(); err == nil {
+			t.Errorf("Expected manifest to be invalid: %+v", manifest)
+		}
+	}
+}
@@ -39,6 +39,11 @@ var testCases = []testCase{
 		runVaultPublicClusterTest,
 		false,
 	},
+	{
+		"TestVaultClientCertCluster",
+		runVaultClientCertClusterTest,
+		false,
+	},
 	{
 		"TestVaultEnterpriseClusterAutoUnseal",
 		runVaultEnterpriseClusterTest,
@@ -83,6 +88,9 @@ var packerBuilds = []packerBuild{
 // so the Vault Enterprise versions can be downloaded. You would also need to set these two variables locally to run the
 // tests. The reason behind this is to prevent the actual url from being visible in the code and logs.
 func TestMainVaultCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping the Vault cluster tests in short mode, as they deploy real infrastructure")
+	}
 	t.Parallel()
 
 	test_structure.RunTestStage(t, "build_images", func() {
@@ -0,0 +1,185 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/hashicorp/vault/api"
+)
+
+// How the init, unseal and health helpers talk to the nodes of a Vault cluster
+type VaultTransport int
+
+const (
+	// SSH to each node and run the vault CLI and curl against 127.0.0.1 there. This is the default, as it verifies that
+	// the self-signed TLS certificate is trusted on the node itself.
+	SshTransport VaultTransport = iota
+	// Use a Vault API client pointed at each node. The nodes have to be reachable on the Vault port from the test.
+	ApiTransport
+)
+
+// The operations the init, unseal and health helpers run against a single Vault node
+type VaultNodeClient interface {
+	Hostname() string
+	Init(options *VaultInitOptions) (*VaultInitResponse, error)
+	SealStatus() (*api.SealStatusResponse, error)
+	Unseal(unsealKey string) (*api.SealStatusResponse, error)
+	ResetUnseal() (*api.SealStatusResponse, error)
+	Health() (*VaultHealth, error)
+	Leader() (*api.LeaderResponse, error)
+}
+
+// Returns a client for the given node that uses the transport of the cluster
+func (c *VaultCluster) NodeClient(t *testing.T, node ssh.Host, bastionHost *ssh.Host) VaultNodeClient {
+	if c.Transport == ApiTransport {
+		return newApiVaultNodeClient(t, node)
+	}
+	return &SshVaultNodeClient{t: t, executor: c.NodeExecutor(t, node, bastionHost)}
+}
+
+// A VaultNodeClient that runs the vault CLI and curl on the node through an Executor, usually over SSH
+type SshVaultNodeClient struct {
+	t        *testing.T
+	executor Executor
+}
+
+func (c *SshVaultNodeClient) Hostname() string {
+	return c.executor.Hostname()
+}
+
+func (c *SshVaultNodeClient) Init(options *VaultInitOptions) (*VaultInitResponse, error) {
+	output, err := runCommand(c.executor, buildVaultInitCommand(options))
+	logger.Logf(c.t, "Vault init output: %s", output)
+	if err != nil {
+		return nil, err
+	}
+	return parseVaultInitResponseE(output)
+}
+
+func (c *SshVaultNodeClient) SealStatus() (*api.SealStatusResponse, error) {
+	return getSealStatusE(c.t, c.executor)
+}
+
+func (c *SshVaultNodeClient) Unseal(unsealKey string) (*api.SealStatusResponse, error) {
+	return submitUnsealKeyE(c.t, c.executor, unsealKey)
+}
+
+func (c *SshVaultNodeClient) ResetUnseal() (*api.SealStatusResponse, error) {
+	return resetUnsealProgressE(c.t, c.executor)
+}
+
+func (c *SshVaultNodeClient) Health() (*VaultHealth, error) {
+	return getNodeHealthE(c.t, c.executor)
+}
+
+func (c *SshVaultNodeClient) Leader() (*api.LeaderResponse, error) {
+	return getNodeLeader(c.t, c.executor)
+}
+
+// A VaultNodeClient that uses a Vault API client pointed at the node
+type ApiVaultNodeClient struct {
+	host   ssh.Host
+	client *api.Client
+}
+
+// Create a VaultNodeClient with a Vault API client pointed at the given node. Retries on 5xx responses are disabled,
+// as sealed and uninitialized nodes return those from /v1/sys/health, and the helpers do their own retries.
+func newApiVaultNodeClient(t *testing.T, node ssh.Host) *ApiVaultNodeClient {
+	client := createVaultClient(t, node.Hostname)
+	client.SetMaxRetries(0)
+	return &ApiVaultNodeClient{host: node, client: client}
+}
+
+func (c *ApiVaultNodeClient) Hostname() string {
+	return c.host.Hostname
+}
+
+func (c *ApiVaultNodeClient) Init(options *VaultInitOptions) (*VaultInitResponse, error) {
+	request := buildVaultInitRequest(options)
+	resp, err := c.client.Sys().Init(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the same response `vault operator init -format=json` prints, so both transports are validated the same way
+	initResponse := &VaultInitResponse{
+		UnsealKeysB64:         resp.KeysB64,
+		UnsealKeysHex:         resp.Keys,
+		UnsealShares:          request.SecretShares,
+		UnsealThreshold:       request.SecretThreshold,
+		RecoveryKeysB64:       resp.RecoveryKeysB64,
+		RecoveryKeysHex:       resp.RecoveryKeys,
+		RecoveryKeysShares:    request.RecoveryShares,
+		RecoveryKeysThreshold: request.RecoveryThreshold,
+		RootToken:             resp.RootToken,
+	}
+	if err := validateVaultInitResponse(initResponse); err != nil {
+		return nil, err
+	}
+	return initResponse, nil
+}
+
+func (c *ApiVaultNodeClient) SealStatus() (*api.SealStatusResponse, error) {
+	return c.client.Sys().SealStatus()
+}
+
+func (c *ApiVaultNodeClient) Unseal(unsealKey string) (*api.SealStatusResponse, error) {
+	return c.client.Sys().Unseal(unsealKey)
+}
+
+func (c *ApiVaultNodeClient) ResetUnseal() (*api.SealStatusResponse, error) {
+	return c.client.Sys().ResetUnsealProcess()
+}
+
+// Read /v1/sys/health without any query parameters. Unlike Sys().Health(), this keeps the status code Vault picks for
+// the role of the node, so both transports return the same thing.
+func (c *ApiVaultNodeClient) Health() (*VaultHealth, error) {
+	resp, err := c.client.RawRequest(c.client.NewRequest("GET", "/v1/sys/health"))
+	if resp == nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var health VaultHealth
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return nil, fmt.Errorf("Failed to parse /v1/sys/health response from host %s: %v", c.host.Hostname, err)
+	}
+	health.StatusCode = VaultStatus(resp.StatusCode)
+	return &health, nil
+}
+
+func (c *ApiVaultNodeClient) Leader() (*api.LeaderResponse, error) {
+	return c.client.Sys().Leader()
+}
+
+// Build the request for /v1/sys/init with the same defaults as `vault operator init`
+func buildVaultInitRequest(options *VaultInitOptions) *api.InitRequest {
+	request := &api.InitRequest{
+		SecretShares:      5,
+		SecretThreshold:   3,
+		RecoveryShares:    5,
+		RecoveryThreshold: 3,
+	}
+	if options == nil {
+		return request
+	}
+
+	if options.KeyShares > 0 {
+		request.SecretShares = options.KeyShares
+	} else if len(options.PgpKeys) > 0 {
+		request.SecretShares = len(options.PgpKeys)
+	}
+	if options.KeyThreshold > 0 {
+		request.SecretThreshold = options.KeyThreshold
+	}
+	for _, pgpKey := range options.PgpKeys {
+		request.PGPKeys = append(request.PGPKeys, pgpKey.PublicKey)
+	}
+	if options.RootTokenPgpKey != nil {
+		request.RootTokenPGPKey = options.RootTokenPgpKey.PublicKey
+	}
+	return request
+}
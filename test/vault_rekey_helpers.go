@@ -0,0 +1,196 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/hashicorp/vault/api"
+)
+
+// Rekey an initialized and unsealed cluster to a new split of unseal keys, rotate the encryption key of the barrier
+// and then restart every node to prove that:
+//
+// 1. The new unseal keys unseal every node.
+// 2. The rotated encryption key survives the restart.
+//
+// The new unseal keys are stored in the given cluster, so save it again afterwards if later stages need them.
+func testVaultRekeyAndRotate(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host, newShares int, newThreshold int) {
+	rekeyVaultCluster(t, cluster, bastionHost, newShares, newThreshold)
+	keyStatus := rotateVaultEncryptionKey(t, cluster, bastionHost)
+
+	restartAndUnsealVaultCluster(t, cluster, bastionHost)
+
+	activeNode := cluster.NodeExecutor(t, cluster.GetActiveNode(t, bastionHost), bastionHost)
+	keyStatusAfterRestart := getVaultKeyStatus(t, activeNode, cluster.RootToken)
+	if keyStatusAfterRestart.Term != keyStatus.Term {
+		t.Fatalf("Expected the encryption key term to be %d after restarting the cluster, but got %d", keyStatus.Term, keyStatusAfterRestart.Term)
+	}
+}
+
+// Run the `vault operator rekey` flow on the active node of the given cluster to split the master key into the given
+// number of shares, of which the given threshold is needed to unseal. The cluster's current unseal keys are used to
+// authorize the rekey and are replaced with the new ones once it completes. Starts over if the node can't be reached.
+func rekeyVaultCluster(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host, newShares int, newThreshold int) {
+	activeNode := cluster.NodeExecutor(t, cluster.GetActiveNode(t, bastionHost), bastionHost)
+	logger.Logf(t, "Rekeying Vault cluster on node %s to %d key shares with a threshold of %d", activeNode.Hostname(), newShares, newThreshold)
+
+	var resp *api.RekeyUpdateResponse
+	description := fmt.Sprintf("Rekeying Vault on node %s", activeNode.Hostname())
+	attempts := 0
+	_, err := retry.DoWithRetryE(t, description, 5, 10*time.Second, func() (string, error) {
+		if attempts > 0 {
+			// The previous attempt lost its connection, so it couldn't cancel its rekey
+			cancelRekey(t, activeNode)
+		}
+		attempts++
+
+		update, err := rekeyVaultE(t, activeNode, cluster.UnsealKeys, newShares, newThreshold)
+		if err != nil {
+			return "", retryOnlyConnectionErrors(err)
+		}
+		resp = update
+		return "", nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to rekey Vault on node %s: %v", activeNode.Hostname(), err)
+	}
+
+	if cluster.InitResponse != nil {
+		cluster.InitResponse.UnsealKeysB64 = resp.KeysB64
+		cluster.InitResponse.UnsealKeysHex = resp.Keys
+		cluster.InitResponse.UnsealShares = newShares
+		cluster.InitResponse.UnsealThreshold = newThreshold
+	}
+	cluster.UnsealKeys = resp.KeysB64[:newThreshold]
+}
+
+// Run the `vault operator rekey` flow on the given node and return the response with the new unseal keys. The flow is:
+//
+// 1. Start a rekey with the new number of shares and threshold, which returns the nonce of the operation.
+// 2. Provide the current unseal keys with that nonce until the threshold is met and Vault returns the new keys.
+//
+// If the keys don't meet the threshold, the rekey is canceled so it doesn't block later attempts. Connection errors are
+// returned as is, and the rekey is left for the next attempt to cancel.
+func rekeyVaultE(t *testing.T, executor Executor, unsealKeys []string, newShares int, newThreshold int) (*api.RekeyUpdateResponse, error) {
+	initCommand := fmt.Sprintf("vault operator rekey -init -key-shares=%d -key-threshold=%d -format=json", newShares, newThreshold)
+	initOutput, err := runCommand(executor, initCommand)
+	if isConnectionError(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start rekey: %v. Output: %s", err, initOutput)
+	}
+
+	var status api.RekeyStatusResponse
+	if err := parseJsonFromCommandOutput(initOutput, &status); err != nil {
+		return nil, fmt.Errorf("Failed to parse rekey status: %v", err)
+	}
+	nonce := status.Nonce
+
+	for i, key := range unsealKeys {
+		output, err := runCommand(executor, fmt.Sprintf("vault operator rekey -nonce='%s' -format=json '%s'", nonce, key))
+		if isConnectionError(err) {
+			return nil, err
+		}
+		if err != nil {
+			cancelRekey(t, executor)
+			return nil, fmt.Errorf("Failed to provide key %d for rekey: %v. Output: %s", i+1, err, output)
+		}
+
+		// Until the threshold is met, the output is the status of the rekey. After that, it's the new unseal keys.
+		var update api.RekeyUpdateResponse
+		if err := parseJsonFromCommandOutput(output, &update); err != nil {
+			cancelRekey(t, executor)
+			return nil, fmt.Errorf("Failed to parse rekey response after key %d: %v", i+1, err)
+		}
+		if update.Complete {
+			if len(update.KeysB64) != newShares {
+				return nil, fmt.Errorf("Expected rekey to return %d unseal keys, but got %d", newShares, len(update.KeysB64))
+			}
+			return &update, nil
+		}
+
+		if err := parseJsonFromCommandOutput(output, &status); err != nil {
+			cancelRekey(t, executor)
+			return nil, fmt.Errorf("Failed to parse rekey status after key %d: %v", i+1, err)
+		}
+		logger.Logf(t, "Rekey progress on %s: %d/%d", executor.Hostname(), status.Progress, status.Required)
+	}
+
+	cancelRekey(t, executor)
+	return nil, fmt.Errorf("Rekey did not complete after %d keys: progress %d/%d", len(unsealKeys), status.Progress, status.Required)
+}
+
+// Cancel any rekey in progress on the given node. Errors are only logged, as this is used for cleanup.
+func cancelRekey(t *testing.T, executor Executor) {
+	output, err := runCommand(executor, "vault operator rekey -cancel")
+	if err != nil {
+		logger.Logf(t, "Failed to cancel rekey on %s: %v. Output: %s", executor.Hostname(), err, output)
+	}
+}
+
+// Rotate the encryption key of the barrier on the active node of the given cluster using its root token, check that
+// the key term went up and return the new key status
+func rotateVaultEncryptionKey(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) *api.KeyStatus {
+	activeNode := cluster.NodeExecutor(t, cluster.GetActiveNode(t, bastionHost), bastionHost)
+	before := getVaultKeyStatus(t, activeNode, cluster.RootToken)
+
+	output, err := runCommand(activeNode, fmt.Sprintf("VAULT_TOKEN='%s' vault operator rotate", cluster.RootToken))
+	if err != nil {
+		t.Fatalf("Failed to rotate the encryption key on Vault node %s: %v. Output: %s", activeNode.Hostname(), err, output)
+	}
+
+	after := getVaultKeyStatus(t, activeNode, cluster.RootToken)
+	if after.Term <= before.Term {
+		t.Fatalf("Expected the encryption key term to go up from %d after rotating, but got %d", before.Term, after.Term)
+	}
+	if !after.InstallTime.After(before.InstallTime) {
+		t.Fatalf("Expected the encryption key installed at %s to be newer than the previous one installed at %s", after.InstallTime, before.InstallTime)
+	}
+
+	logger.Logf(t, "Rotated the encryption key from term %d to term %d", before.Term, after.Term)
+	return after
+}
+
+// Read the term and install time of the current encryption key from sys/key-status on the given node
+func getVaultKeyStatus(t *testing.T, executor Executor, token string) *api.KeyStatus {
+	output, err := runCommand(executor, fmt.Sprintf("VAULT_TOKEN='%s' vault operator key-status -format=json", token))
+	if err != nil {
+		t.Fatalf("Failed to read key status on Vault node %s: %v. Output: %s", executor.Hostname(), err, output)
+	}
+
+	var keyStatus api.KeyStatus
+	if err := parseJsonFromCommandOutput(output, &keyStatus); err != nil {
+		t.Fatalf("Failed to parse key status on Vault node %s: %v", executor.Hostname(), err)
+	}
+	return &keyStatus
+}
+
+// Restart Vault on every node of the given cluster and unseal each one again with the cluster's unseal keys. As all
+// nodes are restarted before any is unsealed, this proves that the current unseal keys work for every node.
+func restartAndUnsealVaultCluster(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) {
+	for _, node := range cluster.Nodes {
+		restartVault(t, cluster.NodeExecutor(t, node, bastionHost))
+	}
+
+	// The first node to be unsealed grabs the HA lock again and becomes the active node
+	initNode := cluster.NodeClient(t, cluster.InitNode(), bastionHost)
+	assertNodeStatus(t, initNode, Sealed)
+	unsealNode(t, initNode, cluster.UnsealKeys)
+	assertNodeStatus(t, initNode, Leader)
+
+	for _, node := range cluster.Nodes[1:] {
+		nodeClient := cluster.NodeClient(t, node, bastionHost)
+		assertNodeStatus(t, nodeClient, Sealed)
+		unsealNode(t, nodeClient, cluster.UnsealKeys)
+		assertNodeStatus(t, nodeClient, Standby)
+	}
+
+	roles := discoverVaultClusterRoles(t, cluster, bastionHost)
+	logger.Logf(t, "Vault cluster roles after restarting: active node is %s, standby nodes are %v", roles.Active.Hostname, getHostnames(roles.Standbys))
+	assertVaultClusterConsistent(t, cluster, bastionHost)
+}
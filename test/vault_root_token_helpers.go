@@ -0,0 +1,350 @@
+package test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/hashicorp/vault/api"
+)
+
+const OTP_CHARACTERS = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// Walk through the root token lifecycle of a hardened deployment against the active node of an initialized and
+// unsealed cluster:
+//
+// 1. Use the root token returned by init to authenticate and confirm it is a root token.
+// 2. Generate a new root token with the unseal or recovery keys.
+// 3. Revoke the root token returned by init and confirm it no longer works.
+//
+// The new root token is stored in the given cluster, so it can be revoked during teardown with revokeRootToken.
+func testRootTokenLifecycle(t *testing.T, cluster *VaultCluster, domainName string) {
+	initClient := createAuthenticatedVaultClient(t, domainName, cluster.RootToken)
+	assertClientIsRoot(t, initClient)
+
+	newRootToken := generateRootTokenWithClient(t, createVaultClient(t, domainName), getRootGenerationKeys(t, cluster))
+	newClient := createAuthenticatedVaultClient(t, domainName, newRootToken)
+	assertClientIsRoot(t, newClient)
+
+	if err := initClient.Auth().Token().RevokeSelf(""); err != nil {
+		t.Fatalf("Failed to revoke the root token returned by init: %v", err)
+	}
+	if _, err := initClient.Auth().Token().LookupSelf(); err == nil {
+		t.Fatalf("Expected the root token returned by init to be revoked, but it still works")
+	}
+	logger.Logf(t, "Revoked the root token returned by init and switched to a newly generated root token")
+
+	cluster.RootToken = newRootToken
+}
+
+// Create a Vault client configured to talk to Vault running at the given domain name, authenticated with the given token
+func createAuthenticatedVaultClient(t *testing.T, domainName string, token string) *api.Client {
+	client := createVaultClient(t, domainName)
+	client.SetToken(token)
+	return client
+}
+
+// Check that the token the given client is authenticated with is valid and has the root policy
+func assertClientIsRoot(t *testing.T, client *api.Client) {
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		t.Fatalf("Failed to look up the token of the Vault client: %v", err)
+	}
+	assertSecretHasRootPolicy(t, secret)
+}
+
+// Generate a new root token for the given cluster on its active node, using the recovery keys if the cluster uses
+// auto-unseal and the unseal keys otherwise
+func generateRootTokenForCluster(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) string {
+	activeNode := cluster.NodeExecutor(t, cluster.GetActiveNode(t, bastionHost), bastionHost)
+	return generateRootToken(t, activeNode, getRootGenerationKeys(t, cluster))
+}
+
+// Revoke the root token stored in the given cluster on its active node. Use this during teardown, so that no root token
+// outlives the test.
+func revokeRootToken(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) {
+	if cluster.RootToken == "" {
+		logger.Logf(t, "No root token to revoke")
+		return
+	}
+
+	activeNode := cluster.NodeExecutor(t, cluster.GetActiveNode(t, bastionHost), bastionHost)
+	revokeToken(t, activeNode, cluster.RootToken)
+	cluster.RootToken = ""
+}
+
+// Returns the keys that generate-root needs for the given cluster: recovery keys if it uses auto-unseal, unseal keys
+// otherwise
+func getRootGenerationKeys(t *testing.T, cluster *VaultCluster) []string {
+	if len(cluster.RecoveryKeys) > 0 {
+		return cluster.RecoveryKeys
+	}
+	if len(cluster.UnsealKeys) > 0 {
+		return cluster.UnsealKeys
+	}
+	t.Fatalf("The Vault cluster has neither recovery keys nor unseal keys to generate a root token with")
+	return nil
+}
+
+// Run the generate-root flow through the Vault API with the given client and return the new root token. This is the
+// same flow as generateRootTokenE, with the OTP generated and the token decoded in Go. Starts over if the connection to
+// Vault is lost.
+func generateRootTokenWithClient(t *testing.T, client *api.Client, keys []string) string {
+	description := fmt.Sprintf("Generating a root token at %s", client.Address())
+	attempts := 0
+	token, err := retry.DoWithRetryE(t, description, 5, 10*time.Second, func() (string, error) {
+		if attempts > 0 {
+			// The previous attempt lost its connection, so it couldn't cancel its root token generation
+			client.Sys().GenerateRootCancel()
+		}
+		attempts++
+
+		token, err := generateRootTokenWithClientE(client, keys)
+		return token, retryOnlyConnectionErrors(err)
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate a root token at %s: %v", client.Address(), err)
+	}
+	return token
+}
+
+// Run the generate-root flow through the Vault API with the given client and return the new root token. Connection
+// errors are returned as is, and the generation is left for the next attempt to cancel.
+func generateRootTokenWithClientE(client *api.Client, keys []string) (string, error) {
+	status, err := client.Sys().GenerateRootStatus()
+	if err != nil {
+		return "", err
+	}
+	if status.OTPLength == 0 {
+		return "", fmt.Errorf("Vault did not report an OTP length. Versions of Vault before 0.9.6 are not supported.")
+	}
+
+	otp, err := generateOtp(status.OTPLength)
+	if err != nil {
+		return "", err
+	}
+
+	status, err = client.Sys().GenerateRootInit(otp, "")
+	if isConnectionError(err) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to start root token generation: %v", err)
+	}
+	nonce := status.Nonce
+
+	for i, key := range keys {
+		if status.Complete {
+			break
+		}
+		status, err = client.Sys().GenerateRootUpdate(key, nonce)
+		if isConnectionError(err) {
+			return "", err
+		}
+		if err != nil {
+			client.Sys().GenerateRootCancel()
+			return "", fmt.Errorf("Failed to provide key %d for root token generation: %v", i+1, err)
+		}
+	}
+
+	if !status.Complete {
+		client.Sys().GenerateRootCancel()
+		return "", fmt.Errorf("Root token generation did not complete after %d keys: progress %d/%d", len(keys), status.Progress, status.Required)
+	}
+
+	encodedToken := status.EncodedToken
+	if encodedToken == "" {
+		encodedToken = status.EncodedRootToken
+	}
+	return decodeRootToken(encodedToken, otp)
+}
+
+// Generate a random OTP of the given length from the characters Vault uses for tokens
+func generateOtp(length int) (string, error) {
+	otp := make([]byte, length)
+	for i := range otp {
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(OTP_CHARACTERS))))
+		if err != nil {
+			return "", err
+		}
+		otp[i] = OTP_CHARACTERS[index.Int64()]
+	}
+	return string(otp), nil
+}
+
+// Decode a root token that Vault encoded with the given OTP. Vault XORs the token with the OTP and base64-encodes the
+// result without padding.
+func decodeRootToken(encodedToken string, otp string) (string, error) {
+	tokenBytes, err := base64.RawStdEncoding.DecodeString(encodedToken)
+	if err != nil {
+		return "", fmt.Errorf("Failed to base64 decode the encoded root token: %v", err)
+	}
+	if len(tokenBytes) != len(otp) {
+		return "", fmt.Errorf("Expected the encoded root token to be %d bytes like the OTP, but it is %d bytes", len(otp), len(tokenBytes))
+	}
+
+	for i := range tokenBytes {
+		tokenBytes[i] ^= otp[i]
+	}
+	return string(tokenBytes), nil
+}
+
+// Prove that the recovery keys of a cluster that uses auto-unseal can still be used to recover it, by generating a new
+// root token with them on the active node. The new token is checked and revoked again, so it doesn't outlive the check.
+func verifyRecoveryKeys(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host) {
+	if len(cluster.RecoveryKeys) == 0 {
+		t.Fatalf("Expected the Vault cluster to have recovery keys, but it has none. Was it initialized with auto-unseal?")
+	}
+
+	activeNode := cluster.NodeExecutor(t, cluster.GetActiveNode(t, bastionHost), bastionHost)
+	logger.Logf(t, "Generating a root token on Vault node %s using %d recovery keys", activeNode.Hostname(), len(cluster.RecoveryKeys))
+
+	token := generateRootToken(t, activeNode, cluster.RecoveryKeys)
+	assertTokenIsRoot(t, activeNode, token)
+	revokeToken(t, activeNode, token)
+}
+
+// Run the `vault operator generate-root` flow on the given node and return the new root token. The given keys are the
+// unseal keys or, for clusters that use auto-unseal, the recovery keys. Starts over if the node can't be reached.
+func generateRootToken(t *testing.T, executor Executor, keys []string) string {
+	description := fmt.Sprintf("Generating a root token on Vault node %s", executor.Hostname())
+	attempts := 0
+	token, err := retry.DoWithRetryE(t, description, 5, 10*time.Second, func() (string, error) {
+		if attempts > 0 {
+			// The previous attempt lost its connection, so it couldn't cancel its root token generation
+			cancelRootTokenGeneration(t, executor)
+		}
+		attempts++
+
+		token, err := generateRootTokenE(t, executor, keys)
+		return token, retryOnlyConnectionErrors(err)
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate a root token on Vault node %s: %v", executor.Hostname(), err)
+	}
+	return token
+}
+
+// Run the `vault operator generate-root` flow on the given node and return the new root token. The flow is:
+//
+// 1. Generate a one-time password (OTP) that Vault uses to encode the new token.
+// 2. Start a root token generation with that OTP, which returns the nonce of the operation.
+// 3. Provide keys with that nonce until the threshold is met and Vault returns the encoded token.
+// 4. Decode the token with the OTP.
+//
+// If the keys don't meet the threshold, the generation is canceled so it doesn't block later attempts. Connection errors
+// are returned as is, and the generation is left for the next attempt to cancel.
+func generateRootTokenE(t *testing.T, executor Executor, keys []string) (string, error) {
+	otpOutput, err := runCommand(executor, "vault operator generate-root -generate-otp")
+	if isConnectionError(err) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate OTP: %v. Output: %s", err, otpOutput)
+	}
+	otp := strings.TrimSpace(otpOutput)
+
+	initOutput, err := runCommand(executor, fmt.Sprintf("vault operator generate-root -init -otp='%s' -format=json", otp))
+	if isConnectionError(err) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to start root token generation: %v. Output: %s", err, initOutput)
+	}
+
+	var status api.GenerateRootStatusResponse
+	if err := parseJsonFromCommandOutput(initOutput, &status); err != nil {
+		return "", fmt.Errorf("Failed to parse root token generation status: %v", err)
+	}
+	nonce := status.Nonce
+
+	for i, key := range keys {
+		if status.Complete {
+			break
+		}
+
+		output, err := runCommand(executor, fmt.Sprintf("vault operator generate-root -nonce='%s' -format=json '%s'", nonce, key))
+		if isConnectionError(err) {
+			return "", err
+		}
+		if err != nil {
+			cancelRootTokenGeneration(t, executor)
+			return "", fmt.Errorf("Failed to provide key %d for root token generation: %v. Output: %s", i+1, err, output)
+		}
+		if err := parseJsonFromCommandOutput(output, &status); err != nil {
+			cancelRootTokenGeneration(t, executor)
+			return "", fmt.Errorf("Failed to parse root token generation status after key %d: %v", i+1, err)
+		}
+		logger.Logf(t, "Root token generation progress on %s: %d/%d", executor.Hostname(), status.Progress, status.Required)
+	}
+
+	if !status.Complete {
+		cancelRootTokenGeneration(t, executor)
+		return "", fmt.Errorf("Root token generation did not complete after %d keys: progress %d/%d", len(keys), status.Progress, status.Required)
+	}
+
+	encodedToken := status.EncodedToken
+	if encodedToken == "" {
+		encodedToken = status.EncodedRootToken
+	}
+
+	decodeOutput, err := runCommand(executor, fmt.Sprintf("vault operator generate-root -decode='%s' -otp='%s'", encodedToken, otp))
+	if isConnectionError(err) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode root token: %v. Output: %s", err, decodeOutput)
+	}
+	return strings.TrimSpace(decodeOutput), nil
+}
+
+// Cancel any root token generation in progress on the given node. Errors are only logged, as this is used for cleanup.
+func cancelRootTokenGeneration(t *testing.T, executor Executor) {
+	output, err := runCommand(executor, "vault operator generate-root -cancel")
+	if err != nil {
+		logger.Logf(t, "Failed to cancel root token generation on %s: %v. Output: %s", executor.Hostname(), err, output)
+	}
+}
+
+// Check that the given token is valid on the given node and has the root policy
+func assertTokenIsRoot(t *testing.T, executor Executor, token string) {
+	output, err := runCommand(executor, fmt.Sprintf("VAULT_TOKEN='%s' vault token lookup -format=json", token))
+	if err != nil {
+		t.Fatalf("Failed to look up token on Vault node %s: %v. Output: %s", executor.Hostname(), err, output)
+	}
+
+	var secret api.Secret
+	if err := parseJsonFromCommandOutput(output, &secret); err != nil {
+		t.Fatalf("Failed to parse token lookup on Vault node %s: %v", executor.Hostname(), err)
+	}
+	assertSecretHasRootPolicy(t, &secret)
+}
+
+// Check that the given token lookup response has the root policy
+func assertSecretHasRootPolicy(t *testing.T, secret *api.Secret) {
+	policies, err := secret.TokenPolicies()
+	if err != nil {
+		t.Fatalf("Failed to read policies of token: %v", err)
+	}
+	for _, policy := range policies {
+		if policy == "root" {
+			return
+		}
+	}
+	t.Fatalf("Expected token to have the root policy, but it has %v", policies)
+}
+
+// Revoke the given token on the given node
+func revokeToken(t *testing.T, executor Executor, token string) {
+	output, err := runCommand(executor, fmt.Sprintf("VAULT_TOKEN='%s' vault token revoke -self", token))
+	if err != nil {
+		t.Fatalf("Failed to revoke token on Vault node %s: %v. Output: %s", executor.Hostname(), err, output)
+	}
+}
@@ -0,0 +1,174 @@
+package test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/hashicorp/vault/api"
+)
+
+// How long the cert a Vault node serves has to stay valid for at least
+const MIN_TLS_CERT_VALIDITY = 7 * 24 * time.Hour
+
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// The names clients reach Vault at: vault.service.consul through Consul DNS, and 127.0.0.1 from the node itself
+var vaultTlsCertSans = []string{"vault.service.consul", "127.0.0.1"}
+
+// Check that every node of the given cluster serves the given cert on port 8200, through an SSH tunnel via the given
+// bastion host or, if there is no bastion host, via the node itself
+func assertVaultNodesServeCert(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host, tlsCert TlsCert) {
+	cluster.RefreshSshAccess(t)
+
+	results := cluster.ForEachNode(DEFAULT_MAX_PARALLEL_NODES, func(node ssh.Host) (string, error) {
+		tunnel, err := openVaultTunnelE(node, bastionHost)
+		if err != nil {
+			return "", err
+		}
+		defer tunnel.Close()
+
+		out, err := checkServedCertE(tunnel.LocalAddress, tlsCert)
+		return out, tunnel.withLastError(err)
+	})
+	if err := results.Check(RequireAll); err != nil {
+		t.Fatalf("Vault nodes did not serve the expected TLS cert: %v", err)
+	}
+	for _, hostname := range results.Succeeded() {
+		logger.Logf(t, "Vault node %s: %s", hostname, results[hostname].Output)
+	}
+}
+
+// Check that the TLS listener at the given host:port serves the given cert
+func assertServedCert(t *testing.T, address string, tlsCert TlsCert) {
+	out, err := checkServedCertE(address, tlsCert)
+	if err != nil {
+		t.Fatalf("%s did not serve the expected TLS cert: %v", address, err)
+	}
+	logger.Logf(t, out)
+}
+
+// Do a TLS handshake with the listener at the given host:port and check that the cert it serves is the given cert,
+// that it chains up to the CA of the given cert, is valid for the names Vault is reached at, and isn't about to expire
+func checkServedCertE(address string, tlsCert TlsCert) (string, error) {
+	chain, err := getServedCertChainE(address)
+	if err != nil {
+		return "", err
+	}
+	if err := checkCertChain(chain, tlsCert, vaultTlsCertSans, time.Now().Add(MIN_TLS_CERT_VALIDITY)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Serves the expected TLS cert with serial %s, valid until %s", chain[0].SerialNumber, chain[0].NotAfter), nil
+}
+
+// Do a TLS handshake with the listener at the given host:port and return the cert chain it serves, leaf first
+func getServedCertChainE(address string) ([]*x509.Certificate, error) {
+	// Don't let the handshake verify the cert, so we get to check it ourselves and report what exactly is wrong with it
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: TLS_HANDSHAKE_TIMEOUT}, "tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s failed: %v", address, err)
+	}
+	defer conn.Close()
+
+	chain := conn.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s did not serve a TLS cert", address)
+	}
+	return chain, nil
+}
+
+// Check that the leaf of the given chain is the cert at tlsCert.PublicKeyPath, that the chain verifies against the CA
+// at tlsCert.CAPublicKeyPath, that the leaf is valid for each of the given names and is still valid at validUntil
+func checkCertChain(chain []*x509.Certificate, tlsCert TlsCert, names []string, validUntil time.Time) error {
+	expected, err := loadCertificateE(tlsCert.PublicKeyPath)
+	if err != nil {
+		return err
+	}
+	ca, err := loadCertificateE(tlsCert.CAPublicKeyPath)
+	if err != nil {
+		return err
+	}
+
+	leaf := chain[0]
+	if !bytes.Equal(leaf.Raw, expected.Raw) {
+		return fmt.Errorf("Expected the cert with serial %s (%s), but got the cert with serial %s (%s)", expected.SerialNumber, expected.Subject, leaf.SerialNumber, leaf.Subject)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("The cert does not verify against the CA %s: %v", ca.Subject, err)
+	}
+
+	missing := []string{}
+	for _, name := range names {
+		if err := leaf.VerifyHostname(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("The cert is not valid for %s. It's valid for DNS names %v and IP addresses %v.", strings.Join(missing, ", "), leaf.DNSNames, leaf.IPAddresses)
+	}
+
+	if leaf.NotAfter.Before(validUntil) {
+		return fmt.Errorf("The cert expires at %s, which is before %s", leaf.NotAfter, validUntil)
+	}
+	return nil
+}
+
+// Check that Vault at the given address, e.g. https://127.0.0.1:8200, rejects a client that verifies its cert with the
+// given TLS config but doesn't present a client cert, as it does when run with --tls-require-and-verify-client-cert
+func assertVaultRejectsClientWithoutCert(t *testing.T, address string, tlsConfig *api.TLSConfig) {
+	withoutClientCert := *tlsConfig
+	withoutClientCert.ClientCert = ""
+	withoutClientCert.ClientKey = ""
+
+	client := createVaultClientForAddress(t, address, &withoutClientCert)
+	// Retrying won't make the handshake succeed
+	client.SetMaxRetries(0)
+	_, err := client.Sys().Health()
+	if err == nil {
+		t.Fatalf("Expected Vault at %s to reject a client without a client cert, but the request succeeded", address)
+	}
+	logger.Logf(t, "Vault at %s rejected a client without a client cert: %v", address, err)
+}
+
+// Check that every node of the given cluster, whose listeners run with --tls-require-and-verify-client-cert, accepts the
+// given client cert and rejects clients without one. The nodes are reached through SSH tunnels via the given bastion
+// host or, if there is none, via the nodes themselves.
+func assertVaultNodesRequireClientCert(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host, clientTlsCert ClientTlsCert) {
+	cluster.RefreshSshAccess(t)
+	tlsConfig := getDefaultVaultTlsConfig(t)
+
+	for _, node := range cluster.Nodes {
+		assertVaultNodeRequiresClientCert(t, node, bastionHost, tlsConfig, clientTlsCert)
+	}
+}
+
+// Check through an SSH tunnel that the given node accepts the given client cert and rejects clients without one
+func assertVaultNodeRequiresClientCert(t *testing.T, node ssh.Host, bastionHost *ssh.Host, tlsConfig *api.TLSConfig, clientTlsCert ClientTlsCert) {
+	tunnel := openVaultTunnel(t, node, bastionHost)
+	defer tunnel.Close()
+	address := fmt.Sprintf("https://%s", tunnel.LocalAddress)
+
+	// Vault may still be starting, so only check that it rejects clients without a cert once it accepted ours
+	client := createVaultClientForAddress(t, address, getVaultClientCertTlsConfig(tlsConfig, clientTlsCert))
+	description := fmt.Sprintf("Checking that Vault on %s accepts the client cert", node.Hostname)
+	retry.DoWithRetry(t, description, 30, 10*time.Second, func() (string, error) {
+		_, err := client.Sys().Health()
+		return "", tunnel.withLastError(err)
+	})
+	assertVaultRejectsClientWithoutCert(t, address, tlsConfig)
+}
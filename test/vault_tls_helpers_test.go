@@ -0,0 +1,183 @@
+package test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/hashicorp/vault/api"
+)
+
+// Start a TLS listener that serves the given cert and completes the handshake of every connection. Close the listener
+// when done with it.
+func startTestTlsListener(t *testing.T, tlsCert TlsCert) net.Listener {
+	keyPair, err := tls.LoadX509KeyPair(tlsCert.PublicKeyPath, tlsCert.PrivateKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{keyPair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestCheckServedCert(t *testing.T) {
+	t.Parallel()
+
+	tlsCert := generateSelfSignedTlsCert(t)
+	defer cleanupTLSCertFiles(tlsCert)
+	listener := startTestTlsListener(t, tlsCert)
+	defer listener.Close()
+
+	assertServedCert(t, listener.Addr().String(), tlsCert)
+}
+
+func TestCheckServedCertFailsOnWrongCert(t *testing.T) {
+	t.Parallel()
+
+	tlsCert := generateSelfSignedTlsCert(t)
+	defer cleanupTLSCertFiles(tlsCert)
+	otherTlsCert := generateSelfSignedTlsCert(t)
+	defer cleanupTLSCertFiles(otherTlsCert)
+	listener := startTestTlsListener(t, otherTlsCert)
+	defer listener.Close()
+
+	if _, err := checkServedCertE(listener.Addr().String(), tlsCert); err == nil || !strings.Contains(err.Error(), "Expected the cert with serial") {
+		t.Fatalf("Expected a cert other than the expected one to fail, but got: %v", err)
+	}
+
+	// The right leaf with the wrong CA
+	mixedTlsCert := TlsCert{CAPublicKeyPath: tlsCert.CAPublicKeyPath, PublicKeyPath: otherTlsCert.PublicKeyPath}
+	if _, err := checkServedCertE(listener.Addr().String(), mixedTlsCert); err == nil || !strings.Contains(err.Error(), "does not verify against the CA") {
+		t.Fatalf("Expected a cert signed by another CA to fail, but got: %v", err)
+	}
+}
+
+func TestCheckServedCertFailsOnMissingSans(t *testing.T) {
+	t.Parallel()
+
+	options := getDefaultTlsCertOptions()
+	options.DnsNames = []string{"vault.example.com"}
+	tlsCert := generateTlsCert(t, options)
+	defer cleanupTLSCertFiles(tlsCert)
+	listener := startTestTlsListener(t, tlsCert)
+	defer listener.Close()
+
+	_, err := checkServedCertE(listener.Addr().String(), tlsCert)
+	if err == nil || !strings.Contains(err.Error(), "not valid for vault.service.consul") {
+		t.Fatalf("Expected a cert without the vault.service.consul SAN to fail, but got: %v", err)
+	}
+}
+
+func TestCheckServedCertFailsCloseToExpiry(t *testing.T) {
+	t.Parallel()
+
+	options := getDefaultTlsCertOptions()
+	options.ValidityPeriodHours = 24
+	tlsCert := generateTlsCert(t, options)
+	defer cleanupTLSCertFiles(tlsCert)
+	listener := startTestTlsListener(t, tlsCert)
+	defer listener.Close()
+
+	_, err := checkServedCertE(listener.Addr().String(), tlsCert)
+	if err == nil || !strings.Contains(err.Error(), "expires at") {
+		t.Fatalf("Expected a cert that expires in a day to fail, but got: %v", err)
+	}
+}
+
+func TestCheckServedCertThroughSshTunnel(t *testing.T) {
+	t.Parallel()
+
+	tlsCert := generateSelfSignedTlsCert(t)
+	defer cleanupTLSCertFiles(tlsCert)
+	listener := startTestTlsListener(t, tlsCert)
+	defer listener.Close()
+
+	server := startTestSshServer(t, ssh.GenerateRSAKeyPair(t, 2048), &FakeExecutor{Host: "bastion"})
+	defer server.Stop()
+
+	tunnel, err := openSshTunnelE([]SshHop{server.Hop()}, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to open SSH tunnel: %v", err)
+	}
+	defer tunnel.Close()
+
+	assertServedCert(t, tunnel.LocalAddress, tlsCert)
+}
+
+// Start a Vault health endpoint that serves the given cert and, like a listener with
+// tls_require_and_verify_client_cert, only accepts clients that present a cert signed by the CA of the given cert
+func startTestClientCertVaultServer(t *testing.T, tlsCert TlsCert) *httptest.Server {
+	keyPair, err := tls.LoadX509KeyPair(tlsCert.PublicKeyPath, tlsCert.PrivateKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(loadCertificate(t, tlsCert.CAPublicKeyPath))
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"initialized":true,"sealed":false,"standby":false}`)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	// Keep the handshake errors of the rejected clients out of the test output
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	return server
+}
+
+func TestVaultRequiresClientCert(t *testing.T) {
+	t.Parallel()
+
+	tlsCert := generateSelfSignedTlsCert(t)
+	defer cleanupTLSCertFiles(tlsCert)
+	vault := startTestClientCertVaultServer(t, tlsCert)
+	defer vault.Close()
+
+	tlsConfig := &api.TLSConfig{CACert: tlsCert.CAPublicKeyPath, TLSServerName: VAULT_TLS_SERVER_NAME}
+	assertVaultRejectsClientWithoutCert(t, vault.URL, tlsConfig)
+
+	otherTlsCert := generateSelfSignedTlsCert(t)
+	defer cleanupTLSCertFiles(otherTlsCert)
+	otherClientTlsCert := generateClientTlsCert(t, otherTlsCert, "vault-test-client")
+	defer cleanupClientTlsCertFiles(otherClientTlsCert)
+
+	client := createVaultClientForAddress(t, vault.URL, getVaultClientCertTlsConfig(tlsConfig, otherClientTlsCert))
+	client.SetMaxRetries(0)
+	if _, err := client.Sys().Health(); err == nil {
+		t.Fatal("Expected a client cert signed by another CA to be rejected")
+	}
+
+	clientTlsCert := generateClientTlsCert(t, tlsCert, "vault-test-client")
+	defer cleanupClientTlsCertFiles(clientTlsCert)
+
+	client = createVaultClientForAddress(t, vault.URL, getVaultClientCertTlsConfig(tlsConfig, clientTlsCert))
+	if _, err := client.Sys().Health(); err != nil {
+		t.Fatalf("Expected a client cert signed by the CA to be accepted, but got: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+)
+
+// Where the vault-consul-image example puts the TLS files, which run-vault points the listener at
+const VAULT_TLS_DIR = "/opt/vault/tls"
+
+// The name the rotated CA is installed under in VAULT_TLS_DIR. The CA baked into the image keeps ca.crt.pem, as run-vault
+// may be pointed at it with --tls-client-ca-file, and rotating the server cert mustn't change which client certs Vault
+// trusts.
+const ROTATED_CA_FILE_NAME = "rotated-ca.crt.pem"
+
+// The name the rotated CA is added to the OS certificate store under. The update-certificate-store module adds the CA
+// baked into the image as custom.crt, which stays, so curl on the nodes trusts both while the certs are rotated.
+const ROTATED_CA_CERT_STORE_FILE_NAME = "vault-rotated-ca.crt"
+
+// How often the pollers send a request to each node while the certs are rotated
+const TLS_ROTATION_POLL_INTERVAL = 200 * time.Millisecond
+
+// Rotate the TLS cert of every node of the given cluster to a new cert signed by a new CA, without restarting Vault,
+// and check that no request to any node fails while doing so. The nodes are reached through SSH tunnels via the given
+// bastion host or, if there is none, via the nodes themselves. Returns the new cert, whose files the caller has to
+// clean up with cleanupTLSCertFiles.
+func testVaultTlsCertRotation(t *testing.T, cluster *VaultCluster, bastionHost *ssh.Host, oldTlsCert TlsCert) TlsCert {
+	cluster.RefreshSshAccess(t)
+	newTlsCert := generateSelfSignedTlsCert(t)
+
+	// Clients have to trust both CAs while the nodes switch from one cert to the other
+	caPool := x509.NewCertPool()
+	for _, path := range []string{oldTlsCert.CAPublicKeyPath, newTlsCert.CAPublicKeyPath} {
+		caPool.AddCert(loadCertificate(t, path))
+	}
+	tlsConfig := &tls.Config{RootCAs: caPool, ServerName: VAULT_TLS_SERVER_NAME}
+
+	tunnels := map[string]*SshTunnel{}
+	pollers := map[string]*VaultHealthPoller{}
+	for _, node := range cluster.Nodes {
+		tunnel := openVaultTunnel(t, node, bastionHost)
+		defer tunnel.Close()
+		tunnels[node.Hostname] = tunnel
+
+		poller := startVaultHealthPoller(tunnel.LocalAddress, tlsConfig, TLS_ROTATION_POLL_INTERVAL)
+		defer poller.Stop()
+		pollers[node.Hostname] = poller
+	}
+
+	// One node at a time, like an operator would, so the cluster keeps serving if something goes wrong
+	for _, node := range cluster.Nodes {
+		executor := cluster.NodeExecutor(t, node, bastionHost)
+		if err := installVaultTlsCertE(executor, newTlsCert); err != nil {
+			t.Fatalf("Failed to rotate the TLS cert of Vault node %s: %v", node.Hostname, err)
+		}
+		waitForNodeToServeCert(t, pollers[node.Hostname].Address, newTlsCert)
+	}
+
+	for _, node := range cluster.Nodes {
+		requests, failures := pollers[node.Hostname].Stop()
+		if len(failures) > 0 {
+			t.Fatalf("%d of %d requests to Vault node %s failed while rotating the TLS certs:\n%s\nLast error of the SSH tunnel: %v", len(failures), requests, node.Hostname, strings.Join(failures, "\n"), tunnels[node.Hostname].LastError())
+		}
+		if requests == 0 {
+			t.Fatalf("No requests were sent to Vault node %s while rotating the TLS certs", node.Hostname)
+		}
+		logger.Logf(t, "All %d requests to Vault node %s succeeded while rotating the TLS certs", requests, node.Hostname)
+	}
+
+	assertVaultNodesServeCert(t, cluster, bastionHost, newTlsCert)
+	return newTlsCert
+}
+
+// Copy the given cert, its key and CA to the TLS dir of a Vault node with the given executor, trust the CA on the
+// node, and send Vault a SIGHUP so it reloads the cert without dropping connections or sealing
+func installVaultTlsCertE(executor Executor, tlsCert TlsCert) error {
+	files := []struct {
+		localPath string
+		name      string
+	}{
+		{tlsCert.CAPublicKeyPath, ROTATED_CA_FILE_NAME},
+		{tlsCert.PublicKeyPath, "vault.crt.pem"},
+		{tlsCert.PrivateKeyPath, "vault.key.pem"},
+	}
+
+	// Write to new files first and move them in place, so Vault never reads a half written file
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file.localPath)
+		if err != nil {
+			return err
+		}
+		command := fmt.Sprintf("sudo tee '%s/%s.new' > /dev/null <<'EOF'\n%s\nEOF", VAULT_TLS_DIR, file.name, strings.TrimSpace(string(contents)))
+		if _, err := runCommand(executor, command); err != nil {
+			return fmt.Errorf("Failed to copy %s to %s: %v", file.name, executor.Hostname(), err)
+		}
+	}
+
+	commands := []string{}
+	for _, file := range files {
+		path := fmt.Sprintf("%s/%s", VAULT_TLS_DIR, file.name)
+		commands = append(commands, fmt.Sprintf("sudo chown vault:vault '%s.new' && sudo chmod 600 '%s.new' && sudo mv -f '%s.new' '%s'", path, path, path, path))
+	}
+	commands = append(commands,
+		fmt.Sprintf("sudo cp '%s/%s' '/usr/local/share/ca-certificates/%s'", VAULT_TLS_DIR, ROTATED_CA_FILE_NAME, ROTATED_CA_CERT_STORE_FILE_NAME),
+		"sudo update-ca-certificates",
+		"sudo supervisorctl signal HUP vault",
+	)
+
+	for _, command := range commands {
+		if _, err := runCommand(executor, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait for the TLS listener at the given host:port to serve the given cert, as Vault reloads it in the background
+func waitForNodeToServeCert(t *testing.T, address string, tlsCert TlsCert) {
+	description := fmt.Sprintf("Waiting for %s to serve the new TLS cert", address)
+	out := retry.DoWithRetry(t, description, 30, 2*time.Second, func() (string, error) {
+		return checkServedCertE(address, tlsCert)
+	})
+	logger.Logf(t, out)
+}
+
+// Sends a request to /v1/sys/health?standbyok=true of a Vault node at a fixed interval in the background, each on a
+// new TLS connection, and records the ones that fail. Stop it when done with it.
+type VaultHealthPoller struct {
+	Address string // The host:port of the Vault node
+
+	client   *http.Client
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+	mutex    sync.Mutex
+	requests int
+	failures []string
+}
+
+// Start sending requests to the Vault node at the given host:port, verifying its cert with the given TLS config
+func startVaultHealthPoller(address string, tlsConfig *tls.Config, interval time.Duration) *VaultHealthPoller {
+	poller := &VaultHealthPoller{
+		Address: address,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// Without keep alives, every request does a handshake, so it checks the cert the node serves at that time
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+		},
+		stop: make(chan struct{}),
+	}
+
+	poller.wg.Add(1)
+	go poller.poll(interval)
+	return poller
+}
+
+func (p *VaultHealthPoller) poll(interval time.Duration) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := p.check()
+
+		p.mutex.Lock()
+		p.requests++
+		if err != nil {
+			p.failures = append(p.failures, fmt.Sprintf("%s: %v", time.Now().Format(time.RFC3339Nano), err))
+		}
+		p.mutex.Unlock()
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *VaultHealthPoller) check() error {
+	response, err := p.client.Get(fmt.Sprintf("https://%s/v1/sys/health?standbyok=true", p.Address))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Got status code %d", response.StatusCode)
+	}
+	return nil
+}
+
+// Stop sending requests, and return how many were sent and a description of each one that failed. It's safe to call
+// more than once.
+func (p *VaultHealthPoller) Stop() (int, []string) {
+	p.once.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+	})
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.requests, append([]string{}, p.failures...)
+}
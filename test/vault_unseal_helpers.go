@@ -0,0 +1,133 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/hashicorp/vault/api"
+)
+
+// Unseal the given Vault node using the given unseal keys. Retries while the node can't be reached, e.g. because
+// Vault is still starting, but fails right away if the node rejects a key or doesn't count it towards the threshold.
+func unsealNode(t *testing.T, node VaultNodeClient, unsealKeys []string) {
+	description := fmt.Sprintf("Unsealing Vault on host %s", node.Hostname())
+	out := retry.DoWithRetry(t, description, 10, 10*time.Second, func() (string, error) {
+		return unsealNodeE(t, node, unsealKeys)
+	})
+	logger.Logf(t, out)
+}
+
+// Unseal the given Vault node by submitting the given unseal keys to /v1/sys/unseal one at a time, and check through
+// the returned seal status that each key moves the unseal progress forward by one. Any progress left over from an
+// earlier, interrupted attempt is reset first, so keys are never counted twice. Connection errors are returned as is,
+// so the next attempt starts over. Any other error, like a rejected key, is returned as a retry.FatalError.
+func unsealNodeE(t *testing.T, node VaultNodeClient, unsealKeys []string) (string, error) {
+	status, err := node.SealStatus()
+	if err != nil {
+		return "", retryOnlyConnectionErrors(err)
+	}
+	if !status.Sealed {
+		return fmt.Sprintf("Vault node %s is already unsealed", node.Hostname()), nil
+	}
+
+	if status.Progress > 0 {
+		logger.Logf(t, "Resetting stale unseal progress %d/%d on Vault node %s", status.Progress, status.T, node.Hostname())
+		status, err = node.ResetUnseal()
+		if err != nil {
+			return "", retryOnlyConnectionErrors(err)
+		}
+		if status.Progress != 0 {
+			return "", fmt.Errorf("Expected unseal progress of Vault node %s to be 0 after a reset, but got %d", node.Hostname(), status.Progress)
+		}
+	}
+
+	for i, key := range unsealKeys {
+		expectedProgress := status.Progress + 1
+
+		status, err = node.Unseal(key)
+		if isConnectionError(err) {
+			return "", err
+		}
+		if err != nil {
+			return "", retry.FatalError{Underlying: fmt.Errorf("Vault node %s did not accept unseal key %d of %d: %v", node.Hostname(), i+1, len(unsealKeys), err)}
+		}
+		if !status.Sealed {
+			return fmt.Sprintf("Unsealed Vault node %s with %d of %d unseal keys", node.Hostname(), i+1, len(unsealKeys)), nil
+		}
+		if status.Progress != expectedProgress {
+			return "", retry.FatalError{Underlying: fmt.Errorf("Expected unseal progress of Vault node %s to be %d/%d after unseal key %d of %d, but got %d/%d", node.Hostname(), expectedProgress, status.T, i+1, len(unsealKeys), status.Progress, status.T)}
+		}
+		logger.Logf(t, "Unseal progress on %s: %d/%d", node.Hostname(), status.Progress, status.T)
+	}
+
+	return "", retry.FatalError{Underlying: fmt.Errorf("Vault node %s is still sealed after all %d unseal keys: progress %d/%d", node.Hostname(), len(unsealKeys), status.Progress, status.T)}
+}
+
+// Use curl to read /v1/sys/seal-status on the given Vault node
+func getSealStatusE(t *testing.T, executor Executor) (*api.SealStatusResponse, error) {
+	var status api.SealStatusResponse
+	if err := curlVaultApiE(t, executor, "GET", "sys/seal-status", "", &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Use curl to submit a single unseal key to /v1/sys/unseal on the given Vault node and return the new seal status
+func submitUnsealKeyE(t *testing.T, executor Executor, unsealKey string) (*api.SealStatusResponse, error) {
+	body, err := json.Marshal(map[string]string{"key": unsealKey})
+	if err != nil {
+		return nil, err
+	}
+
+	var status api.SealStatusResponse
+	if err := curlVaultApiE(t, executor, "PUT", "sys/unseal", string(body), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Use curl to discard the unseal keys submitted so far to /v1/sys/unseal on the given Vault node
+func resetUnsealProgressE(t *testing.T, executor Executor) (*api.SealStatusResponse, error) {
+	var status api.SealStatusResponse
+	if err := curlVaultApiE(t, executor, "PUT", "sys/unseal", `{"reset": true}`, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Use curl to send a request to the Vault API on the given node and decode the JSON response into the given target.
+// Returns the errors Vault responded with if the status code isn't a success.
+func curlVaultApiE(t *testing.T, executor Executor, method string, path string, body string, target interface{}) error {
+	curlCommand := fmt.Sprintf("curl -s -w '\\n%%{http_code}' -X %s 'https://127.0.0.1:%d/v1/%s'", method, VAULT_PORT, path)
+	if body != "" {
+		curlCommand = fmt.Sprintf("%s -d '%s'", curlCommand, body)
+	}
+
+	output, err := runCommand(executor, curlCommand)
+	if err != nil {
+		return err
+	}
+
+	responseBody, statusCode, err := parseCurlOutputWithStatusCode(output)
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s /v1/%s response from host %s: %v", method, path, executor.Hostname(), err)
+	}
+
+	if statusCode >= 400 {
+		var errorResponse api.ErrorResponse
+		if err := json.Unmarshal([]byte(responseBody), &errorResponse); err != nil || len(errorResponse.Errors) == 0 {
+			return fmt.Errorf("%s /v1/%s returned status code %d: %s", method, path, statusCode, responseBody)
+		}
+		return fmt.Errorf("%s /v1/%s returned status code %d: %s", method, path, statusCode, strings.Join(errorResponse.Errors, ", "))
+	}
+
+	if err := json.Unmarshal([]byte(responseBody), target); err != nil {
+		return fmt.Errorf("Failed to parse %s /v1/%s response from host %s: %v. Response: %s", method, path, executor.Hostname(), err, responseBody)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+)
+
+const (
+	TEST_SEAL_STATUS_COMMAND = `/v1/sys/seal-status'$`
+	TEST_UNSEAL_COMMAND      = `-X PUT '.*/v1/sys/unseal' -d '\{"key":"key-\d"\}'$`
+	TEST_RESET_COMMAND       = `-X PUT '.*/v1/sys/unseal' -d '\{"reset": true\}'$`
+)
+
+// Returns a client for a fake Vault node that runs the given script behind an in-process SSH server
+func newTestSshVaultNodeClient(t *testing.T, script []ScriptedCommand) (*SshVaultNodeClient, *FakeExecutor, *TestSshServer) {
+	backend := &FakeExecutor{Host: "vault-node-0", Script: script}
+	server := startTestSshServer(t, ssh.GenerateRSAKeyPair(t, 2048), backend)
+	return &SshVaultNodeClient{t: t, executor: newMultiHopSshExecutor(server.Hop())}, backend, server
+}
+
+func TestUnsealNodeResetsStaleProgress(t *testing.T) {
+	t.Parallel()
+
+	node, backend, server := newTestSshVaultNodeClient(t, []ScriptedCommand{
+		{Match: TEST_SEAL_STATUS_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":1}` + "\n200"},
+		{Match: TEST_RESET_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":0}` + "\n200"},
+		{Match: TEST_UNSEAL_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":1}` + "\n200"},
+		{Match: TEST_UNSEAL_COMMAND, Output: `{"sealed":false,"t":2,"n":3,"progress":0}` + "\n200"},
+	})
+	defer server.Stop()
+
+	unsealNode(t, node, []string{"key-1", "key-2", "key-3"})
+
+	if err := backend.CheckScriptDone(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnsealNodeSkipsUnsealedNode(t *testing.T) {
+	t.Parallel()
+
+	node, backend, server := newTestSshVaultNodeClient(t, []ScriptedCommand{
+		{Match: TEST_SEAL_STATUS_COMMAND, Output: `{"sealed":false,"t":2,"n":3,"progress":0}` + "\n200"},
+	})
+	defer server.Stop()
+
+	unsealNode(t, node, []string{"key-1", "key-2"})
+
+	if err := backend.CheckScriptDone(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnsealNodeFailsOnRejectedKey(t *testing.T) {
+	t.Parallel()
+
+	node, _, server := newTestSshVaultNodeClient(t, []ScriptedCommand{
+		{Match: TEST_SEAL_STATUS_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":0}` + "\n200"},
+		{Match: TEST_UNSEAL_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":1}` + "\n200"},
+		{Match: TEST_UNSEAL_COMMAND, Output: `{"errors":["Error: message authentication failed"]}` + "\n400"},
+	})
+	defer server.Stop()
+
+	_, err := unsealNodeE(t, node, []string{"key-1", "key-2"})
+	if _, ok := err.(retry.FatalError); !ok {
+		t.Fatalf("Expected a rejected key to be a retry.FatalError, but got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "unseal key 2 of 2") || !strings.Contains(err.Error(), "message authentication failed") {
+		t.Fatalf("Expected the error to name the rejected key and Vault's error, but got: %v", err)
+	}
+}
+
+func TestUnsealNodeFailsWhenProgressDoesNotMove(t *testing.T) {
+	t.Parallel()
+
+	node, _, server := newTestSshVaultNodeClient(t, []ScriptedCommand{
+		{Match: TEST_SEAL_STATUS_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":0}` + "\n200"},
+		{Match: TEST_UNSEAL_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":0}` + "\n200"},
+	})
+	defer server.Stop()
+
+	_, err := unsealNodeE(t, node, []string{"key-1", "key-2"})
+	if _, ok := err.(retry.FatalError); !ok {
+		t.Fatalf("Expected a key that isn't counted to be a retry.FatalError, but got: %v", err)
+	}
+}
+
+func TestUnsealNodeRetriesWhenNodeCannotBeReached(t *testing.T) {
+	t.Parallel()
+
+	node, _, server := newTestSshVaultNodeClient(t, []ScriptedCommand{
+		// curl -s prints nothing but the status code of 000, and exits with 7 when it can't connect
+		{Match: TEST_SEAL_STATUS_COMMAND, Output: "\n000", ExitCode: 7},
+	})
+	defer server.Stop()
+
+	_, err := unsealNodeE(t, node, []string{"key-1"})
+	if err == nil {
+		t.Fatal("Expected an unreachable node to fail")
+	}
+	if _, ok := err.(retry.FatalError); ok {
+		t.Fatalf("Expected an unreachable node to be retried, but got a retry.FatalError: %v", err)
+	}
+}
+
+func TestUnsealNodeStartsOverWhenConnectionIsLost(t *testing.T) {
+	t.Parallel()
+
+	executor := &FakeExecutor{Host: "vault-node-0", Script: []ScriptedCommand{
+		{Match: TEST_SEAL_STATUS_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":0}` + "\n200"},
+		{Match: TEST_UNSEAL_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":1}` + "\n200"},
+		{Match: TEST_UNSEAL_COMMAND, Err: &ConnectionError{Hostname: "vault-node-0", Err: fmt.Errorf("connection reset by peer")}},
+		// The next attempt finds the progress of the first key and resets it
+		{Match: TEST_SEAL_STATUS_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":1}` + "\n200"},
+		{Match: TEST_RESET_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":0}` + "\n200"},
+		{Match: TEST_UNSEAL_COMMAND, Output: `{"sealed":true,"t":2,"n":3,"progress":1}` + "\n200"},
+		{Match: TEST_UNSEAL_COMMAND, Output: `{"sealed":false,"t":2,"n":3,"progress":0}` + "\n200"},
+	}}
+	node := &SshVaultNodeClient{t: t, executor: executor}
+
+	_, err := unsealNodeE(t, node, []string{"key-1", "key-2"})
+	if !isConnectionError(err) {
+		t.Fatalf("Expected a lost connection to be returned as a connection error to retry, but got: %v", err)
+	}
+
+	if _, err := unsealNodeE(t, node, []string{"key-1", "key-2"}); err != nil {
+		t.Fatalf("Expected the next attempt to unseal the node, but got: %v", err)
+	}
+	if err := executor.CheckScriptDone(); err != nil {
+		t.Fatal(err)
+	}
+}